@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -9,11 +10,15 @@ import (
 	"net/http"
 	"net/smtp"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // AlertChannel represents a notification channel configuration
@@ -34,6 +39,7 @@ type AlertRule struct {
 	Severity string
 	Enabled  bool
 	Channels []int
+	Params   json.RawMessage // Rule-type settings (alert_rules.params)
 }
 
 // AlertState tracks the current state of a target for de-duplication
@@ -68,9 +74,60 @@ type PollResult struct {
 	Status     string
 	LatencyMs  int
 	Message    string
+	Error      string                 // Failure description, empty when the poll succeeded
+	Data       map[string]interface{} // Typed values collected by the poller (poll_results.data)
 	PolledAt   time.Time
 }
 
+// Reason returns the failure description of a poll, falling back to the
+// free-text message for rows written before the error column existed.
+func (p *PollResult) Reason() string {
+	if p.Error != "" {
+		return p.Error
+	}
+	return p.Message
+}
+
+// TLSCertificate is a certificate the poller saw on an "http" target
+type TLSCertificate struct {
+	Fingerprint   string
+	ChainPosition int
+	Subject       string
+	Issuer        string
+	NotAfter      time.Time
+}
+
+// RebootEvent is a reboot detected by the poller from a sysUpTime decrease
+type RebootEvent struct {
+	ID             int64
+	TargetID       int
+	BootTime       time.Time
+	PreviousUptime int64
+	CurrentUptime  int64
+	DetectedAt     time.Time
+}
+
+// SNMPTrap is a trap or inform received by trapd
+type SNMPTrap struct {
+	ID         int64
+	TargetID   int
+	Source     string
+	Version    string
+	PDUType    string
+	TrapOID    string
+	TrapName   string
+	Varbinds   []TrapVarbind
+	ReceivedAt time.Time
+}
+
+// TrapVarbind is one variable of a trap (snmp_traps.varbinds)
+type TrapVarbind struct {
+	OID   string      `json:"oid"`
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
 // Configuration
 var (
 	db                     *sql.DB
@@ -82,6 +139,7 @@ var (
 	smtpPassword           string
 	smtpFrom               string
 	pagerdutyDefaultKey    string
+	shutdownTimeoutSeconds int
 )
 
 func main() {
@@ -115,15 +173,75 @@ func main() {
 
 	log.Printf("Alerter started (check_interval=%ds, dedup_window=%dmin)", checkIntervalSeconds, dedupWindowMinutes)
 
+	stopping, ctx := shutdownContext(time.Duration(shutdownTimeoutSeconds) * time.Second)
+
+	// trapd notifies auspex_traps for every stored trap, so trap rules run
+	// right away instead of on the next check
+	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("ERROR: trap listener: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen("auspex_traps"); err != nil {
+		log.Printf("ERROR: failed to listen for traps, trap rules run every %ds: %v", checkIntervalSeconds, err)
+	}
+
 	// Run initial check
-	checkForAlerts()
+	checkForAlerts(ctx)
 
 	// Start periodic checking
 	ticker := time.NewTicker(time.Duration(checkIntervalSeconds) * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		checkForAlerts()
+	for stopping.Err() == nil {
+		select {
+		case <-stopping.Done():
+		case <-ticker.C:
+			checkForAlerts(ctx)
+		case <-listener.Notify:
+			// A burst of traps needs only one pass; a nil notification
+			// after a reconnect also lands here and catches up
+			drainNotifications(listener)
+			checkTrapRules(ctx)
+		}
+	}
+	log.Println("Alerter stopped")
+}
+
+// shutdownContext handles SIGTERM and SIGINT. stopping is done as soon as a
+// signal arrives, after which no new check is started; ctx is cancelled
+// drain later (or on a second signal) to abort the check and notifications
+// still in progress.
+func shutdownContext(drain time.Duration) (stopping, ctx context.Context) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	stopping, stop := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, finishing current check (up to %v)", sig, drain)
+		stop()
+
+		select {
+		case <-time.After(drain):
+			log.Printf("Shutdown timeout exceeded, aborting current check")
+		case <-sigs:
+			log.Printf("Received second signal, aborting current check")
+		}
+		cancel()
+	}()
+	return stopping, ctx
+}
+
+func drainNotifications(listener *pq.Listener) {
+	for {
+		select {
+		case <-listener.Notify:
+		default:
+			return
+		}
 	}
 }
 
@@ -153,10 +271,16 @@ func loadConfig() {
 	smtpFrom = getenv("AUSPEX_SMTP_FROM", "auspex-alerts@localhost")
 
 	pagerdutyDefaultKey = getenv("AUSPEX_PAGERDUTY_INTEGRATION_KEY", "")
+
+	shutdownTimeoutStr := getenv("AUSPEX_SHUTDOWN_TIMEOUT_SECONDS", "30")
+	shutdownTimeoutSeconds, err = strconv.Atoi(shutdownTimeoutStr)
+	if err != nil || shutdownTimeoutSeconds <= 0 {
+		shutdownTimeoutSeconds = 30
+	}
 }
 
 // checkForAlerts is the main loop that checks all targets for alert conditions
-func checkForAlerts() {
+func checkForAlerts(ctx context.Context) {
 	log.Println("Checking for alert conditions...")
 
 	// Get all enabled alert rules
@@ -175,11 +299,49 @@ func checkForAlerts() {
 
 	// For each rule, check if conditions are met
 	for _, rule := range rules {
-		processAlertRule(rule)
+		if ctx.Err() != nil {
+			log.Printf("Alert check aborted: %v", ctx.Err())
+			return
+		}
+		processAlertRule(ctx, rule)
+	}
+}
+
+// checkTrapRules runs only the trap rules, when trapd reports new traps
+func checkTrapRules(ctx context.Context) {
+	rules, err := loadAlertRules()
+	if err != nil {
+		log.Printf("ERROR: failed to load alert rules: %v", err)
+		return
+	}
+
+	for _, rule := range rules {
+		if ctx.Err() != nil {
+			log.Printf("Trap check aborted: %v", ctx.Err())
+			return
+		}
+		if rule.RuleType == "trap" {
+			processTrapRule(ctx, rule)
+		}
 	}
 }
 
-func processAlertRule(rule AlertRule) {
+func processAlertRule(ctx context.Context, rule AlertRule) {
+	// Event-based rule types track their own progress instead of alert_state
+	if rule.RuleType == "reboot" {
+		processRebootRule(ctx, rule)
+		return
+	}
+	// cert_expiry rules track alerted certificates in alert_cert_expiry
+	if rule.RuleType == "cert_expiry" {
+		processCertExpiryRule(ctx, rule)
+		return
+	}
+	if rule.RuleType == "trap" {
+		processTrapRule(ctx, rule)
+		return
+	}
+
 	// Get latest poll result for this target
 	pollResult, err := getLatestPollResult(rule.TargetID)
 	if err != nil {
@@ -215,14 +377,14 @@ func processAlertRule(rule AlertRule) {
 		return
 	}
 
-	// Check for status change (up -> down or down -> up)
+	// Check for status change (up, degraded, down or unknown)
 	if state.LastStatus != pollResult.Status {
 		log.Printf("Status change detected for target %d (%s): %s -> %s",
 			rule.TargetID, pollResult.TargetName, state.LastStatus, pollResult.Status)
 
 		// Handle status change based on rule type
 		if rule.RuleType == "status_change" {
-			handleStatusChange(rule, pollResult, state)
+			handleStatusChange(ctx, rule, pollResult, state)
 		}
 
 		// Update state
@@ -244,7 +406,13 @@ func processAlertRule(rule AlertRule) {
 	}
 }
 
-func handleStatusChange(rule AlertRule, pollResult *PollResult, state *AlertState) {
+// handleStatusChange opens a device_down alert when the target goes down and
+// a device_degraded alert when a check crosses its warning threshold. Moving
+// between down and degraded resolves the open alert and opens the other
+// kind; going up resolves it with a device_up notification. "unknown" (the
+// check could not tell, e.g. a plugin returning UNKNOWN) leaves any open
+// alert as it is.
+func handleStatusChange(ctx context.Context, rule AlertRule, pollResult *PollResult, state *AlertState) {
 	// Check if target is currently suppressed
 	if isSuppressed(rule.TargetID) {
 		log.Printf("Target %d (%s) is suppressed, skipping alert", rule.TargetID, pollResult.TargetName)
@@ -254,27 +422,53 @@ func handleStatusChange(rule AlertRule, pollResult *PollResult, state *AlertStat
 	var alertType string
 	var message string
 
-	if pollResult.Status == "down" {
-		// Device went down
+	switch pollResult.Status {
+	case "down", "degraded":
 		alertType = "device_down"
 		message = fmt.Sprintf("Target %s (%s) is DOWN - %s",
-			pollResult.TargetName, pollResult.Host, pollResult.Message)
+			pollResult.TargetName, pollResult.Host, pollResult.Reason())
+		if pollResult.Status == "degraded" {
+			alertType = "device_degraded"
+			message = fmt.Sprintf("Target %s (%s) is DEGRADED - %s",
+				pollResult.TargetName, pollResult.Host, pollResult.Reason())
+		}
 
-		// Create alert if not already active
-		if !state.AlertActive {
-			alertID, err := createAlert(rule, pollResult, alertType, message)
+		if state.AlertActive && state.ActiveAlertID != nil {
+			activeType, err := getAlertType(*state.ActiveAlertID)
 			if err != nil {
-				log.Printf("ERROR: failed to create alert: %v", err)
+				log.Printf("ERROR: failed to load alert #%d: %v", *state.ActiveAlertID, err)
+				return
+			}
+			if activeType == alertType {
 				return
 			}
+			// down <-> degraded: replace the open alert
+			if err := resolveAlert(*state.ActiveAlertID); err != nil {
+				log.Printf("ERROR: failed to resolve alert: %v", err)
+			}
+			state.AlertActive = false
+			state.ActiveAlertID = nil
+		} else if state.AlertActive {
+			return
+		}
 
-			state.AlertActive = true
-			state.ActiveAlertID = &alertID
+		alertID, err := createAlert(rule, pollResult, alertType, message)
+		if err != nil {
+			log.Printf("ERROR: failed to create alert: %v", err)
+			return
+		}
+
+		state.AlertActive = true
+		state.ActiveAlertID = &alertID
+
+		// Send notifications
+		sendNotifications(ctx, rule, pollResult, alertType, message, alertID)
 
-			// Send notifications
-			sendNotifications(rule, pollResult, alertType, message, alertID)
+	case "up":
+		if !state.AlertActive {
+			return
 		}
-	} else if pollResult.Status == "up" && state.AlertActive {
+
 		// Device came back up - resolve the alert
 		alertType = "device_up"
 		message = fmt.Sprintf("Target %s (%s) is back UP (latency: %dms)",
@@ -302,10 +496,411 @@ func handleStatusChange(rule AlertRule, pollResult *PollResult, state *AlertStat
 		state.ActiveAlertID = nil
 
 		// Send recovery notifications
-		sendNotifications(rule, pollResult, alertType, message, alertID)
+		sendNotifications(ctx, rule, pollResult, alertType, message, alertID)
+
+	default:
+		log.Printf("Target %d (%s) status is %s, leaving alerts unchanged",
+			rule.TargetID, pollResult.TargetName, pollResult.Status)
+	}
+}
+
+// processRebootRule alerts once for every reboot event recorded since the
+// rule last ran. The rule's cursor starts at the newest existing event so
+// that enabling a rule does not page for old reboots.
+func processRebootRule(ctx context.Context, rule AlertRule) {
+	cursor, found, err := getRuleCursor(rule.ID)
+	if err != nil {
+		log.Printf("ERROR: failed to get cursor for rule %d: %v", rule.ID, err)
+		return
+	}
+
+	if !found {
+		var latest int64
+		err := db.QueryRow(`
+			SELECT COALESCE(MAX(id), 0) FROM reboot_events WHERE target_id = $1
+		`, rule.TargetID).Scan(&latest)
+		if err != nil {
+			log.Printf("ERROR: failed to initialize cursor for rule %d: %v", rule.ID, err)
+			return
+		}
+		if err := saveRuleCursor(rule.ID, latest); err != nil {
+			log.Printf("ERROR: failed to save cursor for rule %d: %v", rule.ID, err)
+		}
+		return
+	}
+
+	events, err := loadRebootEvents(rule.TargetID, cursor)
+	if err != nil {
+		log.Printf("ERROR: failed to load reboot events for target %d: %v", rule.TargetID, err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	pollResult, err := getLatestPollResult(rule.TargetID)
+	if err != nil || pollResult == nil {
+		log.Printf("ERROR: failed to get latest poll for target %d: %v", rule.TargetID, err)
+		return
+	}
+
+	for _, ev := range events {
+		if ctx.Err() != nil {
+			return
+		}
+		if isSuppressed(rule.TargetID) {
+			log.Printf("Target %d (%s) is suppressed, skipping reboot alert", rule.TargetID, pollResult.TargetName)
+		} else {
+			handleReboot(ctx, rule, pollResult, ev)
+		}
+
+		if err := saveRuleCursor(rule.ID, ev.ID); err != nil {
+			log.Printf("ERROR: failed to save cursor for rule %d: %v", rule.ID, err)
+			return
+		}
+	}
+}
+
+func handleReboot(ctx context.Context, rule AlertRule, pollResult *PollResult, ev RebootEvent) {
+	alertType := "device_reboot"
+	message := fmt.Sprintf("Target %s (%s) REBOOTED at approx %s (uptime was %s, now %s)",
+		pollResult.TargetName, pollResult.Host,
+		ev.BootTime.Local().Format("2006-01-02 15:04:05 MST"),
+		formatTimeTicks(ev.PreviousUptime), formatTimeTicks(ev.CurrentUptime))
+
+	log.Printf("Reboot detected for target %d (%s)", rule.TargetID, pollResult.TargetName)
+
+	alertID, err := createAlert(rule, pollResult, alertType, message)
+	if err != nil {
+		log.Printf("ERROR: failed to create reboot alert: %v", err)
+		return
+	}
+
+	// A reboot is a one-off event, there is nothing to wait for to resolve it
+	if err := resolveAlert(alertID); err != nil {
+		log.Printf("ERROR: failed to resolve reboot alert: %v", err)
+	}
+
+	sendNotifications(ctx, rule, pollResult, alertType, message, alertID)
+}
+
+// certExpiryParams are the params of a cert_expiry rule
+type certExpiryParams struct {
+	Days int `json:"days"` // Alert this many days before not_after
+}
+
+// processCertExpiryRule alerts once for every certificate the target
+// currently serves that expires within the rule's window, and resolves the
+// alert when the certificate is replaced.
+func processCertExpiryRule(ctx context.Context, rule AlertRule) {
+	params := certExpiryParams{Days: 30}
+	if len(rule.Params) > 0 {
+		if err := json.Unmarshal(rule.Params, &params); err != nil {
+			log.Printf("ERROR: invalid params for rule %d: %v", rule.ID, err)
+			return
+		}
+	}
+
+	certs, err := loadCurrentCertificates(rule.TargetID)
+	if err != nil {
+		log.Printf("ERROR: failed to load certificates for target %d: %v", rule.TargetID, err)
+		return
+	}
+
+	alerted, err := loadCertExpiryAlerts(rule.ID)
+	if err != nil {
+		log.Printf("ERROR: failed to load certificate alerts for rule %d: %v", rule.ID, err)
+		return
+	}
+
+	pollResult, err := getLatestPollResult(rule.TargetID)
+	if err != nil || pollResult == nil {
+		log.Printf("ERROR: failed to get latest poll for target %d: %v", rule.TargetID, err)
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, params.Days)
+	expiring := make(map[string]bool)
+	for _, cert := range certs {
+		if ctx.Err() != nil {
+			return
+		}
+		if !cert.NotAfter.Before(cutoff) {
+			continue
+		}
+		expiring[cert.Fingerprint] = true
+		if _, ok := alerted[cert.Fingerprint]; ok {
+			continue
+		}
+		if isSuppressed(rule.TargetID) {
+			log.Printf("Target %d (%s) is suppressed, skipping certificate expiry alert", rule.TargetID, pollResult.TargetName)
+			continue
+		}
+		handleCertExpiring(ctx, rule, pollResult, cert)
+	}
+
+	for fingerprint, alertID := range alerted {
+		if ctx.Err() != nil {
+			return
+		}
+		if expiring[fingerprint] {
+			continue
+		}
+		handleCertRenewed(ctx, rule, pollResult, fingerprint, alertID)
 	}
 }
 
+func handleCertExpiring(ctx context.Context, rule AlertRule, pollResult *PollResult, cert TLSCertificate) {
+	alertType := "cert_expiry"
+	when := fmt.Sprintf("expires in %d days", int(time.Until(cert.NotAfter).Hours()/24))
+	if cert.NotAfter.Before(time.Now()) {
+		when = "has EXPIRED"
+	}
+	message := fmt.Sprintf("Target %s (%s) TLS certificate %s %s (not after %s, issuer %s)",
+		pollResult.TargetName, pollResult.Host, describeCertificate(cert), when,
+		cert.NotAfter.Local().Format("2006-01-02 15:04 MST"), cert.Issuer)
+
+	log.Printf("Certificate expiring for target %d (%s): %s", rule.TargetID, pollResult.TargetName, cert.Fingerprint)
+
+	alertID, err := createAlert(rule, pollResult, alertType, message)
+	if err != nil {
+		log.Printf("ERROR: failed to create certificate expiry alert: %v", err)
+		return
+	}
+
+	if _, err := db.Exec(`
+		INSERT INTO alert_cert_expiry (rule_id, fingerprint_sha256, alert_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (rule_id, fingerprint_sha256) DO UPDATE SET alert_id = EXCLUDED.alert_id
+	`, rule.ID, cert.Fingerprint, alertID); err != nil {
+		log.Printf("ERROR: failed to record certificate alert: %v", err)
+	}
+
+	sendNotifications(ctx, rule, pollResult, alertType, message, alertID)
+}
+
+func handleCertRenewed(ctx context.Context, rule AlertRule, pollResult *PollResult, fingerprint string, alertID *int64) {
+	alertType := "cert_renewed"
+	message := fmt.Sprintf("Target %s (%s) no longer serves expiring TLS certificate %s",
+		pollResult.TargetName, pollResult.Host, fingerprint)
+
+	log.Printf("Certificate replaced for target %d (%s): %s", rule.TargetID, pollResult.TargetName, fingerprint)
+
+	if _, err := db.Exec(`
+		DELETE FROM alert_cert_expiry WHERE rule_id = $1 AND fingerprint_sha256 = $2
+	`, rule.ID, fingerprint); err != nil {
+		log.Printf("ERROR: failed to clear certificate alert: %v", err)
+		return
+	}
+
+	if alertID == nil {
+		return
+	}
+	if err := resolveAlert(*alertID); err != nil {
+		log.Printf("ERROR: failed to resolve certificate alert: %v", err)
+	}
+
+	sendNotifications(ctx, rule, pollResult, alertType, message, *alertID)
+}
+
+// describeCertificate names a certificate by its subject and position in
+// the chain
+func describeCertificate(cert TLSCertificate) string {
+	if cert.ChainPosition == 0 {
+		return fmt.Sprintf("%q", cert.Subject)
+	}
+	return fmt.Sprintf("%q (chain position %d)", cert.Subject, cert.ChainPosition)
+}
+
+// trapParams are the params of a trap rule. A trap matches when its OID
+// is one of TrapOIDs (any trap when empty) and every Varbinds pattern
+// matches a varbind.
+type trapParams struct {
+	TrapOIDs []string          `json:"trap_oids"` // OIDs or names, e.g. "linkDown"
+	Varbinds map[string]string `json:"varbinds"`  // varbind OID or name -> regexp on its value
+}
+
+// trapMatcher is a trap rule's params with the patterns compiled
+type trapMatcher struct {
+	oids     map[string]bool
+	varbinds map[string]*regexp.Regexp
+}
+
+func newTrapMatcher(raw json.RawMessage) (*trapMatcher, error) {
+	var params trapParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &trapMatcher{varbinds: make(map[string]*regexp.Regexp)}
+	if len(params.TrapOIDs) > 0 {
+		m.oids = make(map[string]bool)
+		for _, oid := range params.TrapOIDs {
+			m.oids[strings.TrimPrefix(oid, ".")] = true
+		}
+	}
+	for key, pattern := range params.Varbinds {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("varbind %s: %v", key, err)
+		}
+		m.varbinds[strings.TrimPrefix(key, ".")] = re
+	}
+	return m, nil
+}
+
+func (m *trapMatcher) match(trap SNMPTrap) bool {
+	if m.oids != nil && !m.oids[trap.TrapOID] && (trap.TrapName == "" || !m.oids[trap.TrapName]) {
+		return false
+	}
+	for key, re := range m.varbinds {
+		found := false
+		for _, vb := range trap.Varbinds {
+			if varbindMatchesKey(vb, key) && re.MatchString(varbindValue(vb)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// varbindMatchesKey reports whether key names the varbind, either fully
+// or without its instance suffix ("ifOperStatus" matches "ifOperStatus.3")
+func varbindMatchesKey(vb TrapVarbind, key string) bool {
+	for _, id := range []string{vb.OID, vb.Name} {
+		if id != "" && (id == key || strings.HasPrefix(id, key+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func varbindValue(vb TrapVarbind) string {
+	switch v := vb.Value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", vb.Value)
+}
+
+// processTrapRule alerts once for every matching trap received since the
+// rule last ran. Like reboot rules, the cursor starts at the newest
+// existing trap.
+func processTrapRule(ctx context.Context, rule AlertRule) {
+	matcher, err := newTrapMatcher(rule.Params)
+	if err != nil {
+		log.Printf("ERROR: invalid params for rule %d: %v", rule.ID, err)
+		return
+	}
+
+	cursor, found, err := getRuleCursor(rule.ID)
+	if err != nil {
+		log.Printf("ERROR: failed to get cursor for rule %d: %v", rule.ID, err)
+		return
+	}
+
+	if !found {
+		var latest int64
+		err := db.QueryRow(`
+			SELECT COALESCE(MAX(id), 0) FROM snmp_traps WHERE target_id = $1
+		`, rule.TargetID).Scan(&latest)
+		if err != nil {
+			log.Printf("ERROR: failed to initialize cursor for rule %d: %v", rule.ID, err)
+			return
+		}
+		if err := saveRuleCursor(rule.ID, latest); err != nil {
+			log.Printf("ERROR: failed to save cursor for rule %d: %v", rule.ID, err)
+		}
+		return
+	}
+
+	traps, err := loadTraps(rule.TargetID, cursor)
+	if err != nil {
+		log.Printf("ERROR: failed to load traps for target %d: %v", rule.TargetID, err)
+		return
+	}
+	if len(traps) == 0 {
+		return
+	}
+
+	pollResult, err := getTargetPollResult(rule.TargetID)
+	if err != nil {
+		log.Printf("ERROR: failed to get latest poll for target %d: %v", rule.TargetID, err)
+		return
+	}
+
+	for _, trap := range traps {
+		if ctx.Err() != nil {
+			return
+		}
+		if matcher.match(trap) {
+			if isSuppressed(rule.TargetID) {
+				log.Printf("Target %d (%s) is suppressed, skipping trap alert", rule.TargetID, pollResult.TargetName)
+			} else {
+				handleTrap(ctx, rule, pollResult, trap)
+			}
+		}
+
+		if err := saveRuleCursor(rule.ID, trap.ID); err != nil {
+			log.Printf("ERROR: failed to save cursor for rule %d: %v", rule.ID, err)
+			return
+		}
+	}
+}
+
+func handleTrap(ctx context.Context, rule AlertRule, pollResult *PollResult, trap SNMPTrap) {
+	alertType := "snmp_trap"
+	message := fmt.Sprintf("Target %s (%s) sent TRAP %s", pollResult.TargetName, pollResult.Host, describeTrap(trap))
+	if len(trap.Varbinds) > 0 {
+		vars := make([]string, 0, len(trap.Varbinds))
+		for _, vb := range trap.Varbinds {
+			name := vb.Name
+			if name == "" {
+				name = vb.OID
+			}
+			vars = append(vars, fmt.Sprintf("%s=%s", name, varbindValue(vb)))
+		}
+		message += ": " + strings.Join(vars, ", ")
+	}
+
+	log.Printf("Trap #%d matched rule %d for target %d (%s)", trap.ID, rule.ID, rule.TargetID, pollResult.TargetName)
+
+	alertID, err := createAlert(rule, pollResult, alertType, message)
+	if err != nil {
+		log.Printf("ERROR: failed to create trap alert: %v", err)
+		return
+	}
+
+	// Like a reboot, a trap is a one-off event
+	if err := resolveAlert(alertID); err != nil {
+		log.Printf("ERROR: failed to resolve trap alert: %v", err)
+	}
+
+	sendNotifications(ctx, rule, pollResult, alertType, message, alertID)
+}
+
+func describeTrap(trap SNMPTrap) string {
+	if trap.TrapName != "" {
+		return fmt.Sprintf("%s (%s)", trap.TrapName, trap.TrapOID)
+	}
+	return trap.TrapOID
+}
+
+// formatTimeTicks renders a sysUpTime value (hundredths of a second)
+func formatTimeTicks(ticks int64) string {
+	return (time.Duration(ticks) * 10 * time.Millisecond).Truncate(time.Second).String()
+}
+
 func isSuppressed(targetID int) bool {
 	now := time.Now()
 
@@ -356,6 +951,13 @@ func createAlert(rule AlertRule, pollResult *PollResult, alertType, message stri
 	return alertID, nil
 }
 
+// getAlertType returns the alert_type of an alert_history row
+func getAlertType(alertID int64) (string, error) {
+	var alertType string
+	err := db.QueryRow(`SELECT alert_type FROM alert_history WHERE id = $1`, alertID).Scan(&alertType)
+	return alertType, err
+}
+
 func resolveAlert(alertID int64) error {
 	_, err := db.Exec(`
 		UPDATE alert_history
@@ -370,7 +972,7 @@ func resolveAlert(alertID int64) error {
 	return err
 }
 
-func sendNotifications(rule AlertRule, pollResult *PollResult, alertType, message string, alertID int64) {
+func sendNotifications(ctx context.Context, rule AlertRule, pollResult *PollResult, alertType, message string, alertID int64) {
 	if len(rule.Channels) == 0 {
 		log.Printf("No channels configured for rule %d, skipping notifications", rule.ID)
 		return
@@ -389,13 +991,21 @@ func sendNotifications(rule AlertRule, pollResult *PollResult, alertType, messag
 			continue
 		}
 
+		// Record the notifications a shutdown cut off, instead of
+		// silently dropping them
+		if ctx.Err() != nil {
+			log.Printf("ERROR: Not sending to channel %d (%s), alerter is shutting down", channel.ID, channel.Name)
+			logDelivery(alertID, channel, pollResult, "failed", "not sent: alerter shut down")
+			continue
+		}
+
 		log.Printf("Sending alert to channel %d (%s) type=%s", channel.ID, channel.Name, channel.Type)
 
 		var status, errMsg string
 
 		switch channel.Type {
 		case "pagerduty":
-			err = sendPagerDutyAlert(channel, pollResult, alertType, message, rule.Severity)
+			err = sendPagerDutyAlert(ctx, channel, pollResult, alertType, message, rule.Severity)
 		case "slack_email":
 			err = sendSlackEmailAlert(channel, pollResult, alertType, message, rule.Severity)
 		case "email":
@@ -430,7 +1040,7 @@ func sendNotifications(rule AlertRule, pollResult *PollResult, alertType, messag
 	}
 }
 
-func sendPagerDutyAlert(channel AlertChannel, pollResult *PollResult, alertType, message, severity string) error {
+func sendPagerDutyAlert(ctx context.Context, channel AlertChannel, pollResult *PollResult, alertType, message, severity string) error {
 	// Get routing key from config
 	routingKey, ok := channel.Config["routing_key"].(string)
 	if !ok || routingKey == "" {
@@ -450,7 +1060,7 @@ func sendPagerDutyAlert(channel AlertChannel, pollResult *PollResult, alertType,
 
 	// Determine event_action (trigger for down, resolve for up)
 	eventAction := "trigger"
-	if alertType == "device_up" {
+	if isRecovery(alertType) {
 		eventAction = "resolve"
 	}
 
@@ -458,7 +1068,7 @@ func sendPagerDutyAlert(channel AlertChannel, pollResult *PollResult, alertType,
 	payload := map[string]interface{}{
 		"routing_key":  routingKey,
 		"event_action": eventAction,
-		"dedup_key":    fmt.Sprintf("auspex-target-%d", pollResult.TargetID),
+		"dedup_key":    pagerDutyDedupKey(pollResult.TargetID, alertType),
 		"payload": map[string]interface{}{
 			"summary":   message,
 			"severity":  pdSeverity,
@@ -471,6 +1081,8 @@ func sendPagerDutyAlert(channel AlertChannel, pollResult *PollResult, alertType,
 				"status":      pollResult.Status,
 				"latency_ms":  pollResult.LatencyMs,
 				"message":     pollResult.Message,
+				"error":       pollResult.Error,
+				"data":        pollResult.Data,
 			},
 		},
 	}
@@ -481,11 +1093,14 @@ func sendPagerDutyAlert(channel AlertChannel, pollResult *PollResult, alertType,
 	}
 
 	// Send to PagerDuty Events API v2
-	resp, err := http.Post(
-		"https://events.pagerduty.com/v2/enqueue",
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://events.pagerduty.com/v2/enqueue", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to build PagerDuty request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send to PagerDuty: %v", err)
 	}
@@ -498,6 +1113,24 @@ func sendPagerDutyAlert(channel AlertChannel, pollResult *PollResult, alertType,
 	return nil
 }
 
+// pagerDutyDedupKey groups down/up alerts of a target into one incident;
+// other alert types get their own incident per target.
+func pagerDutyDedupKey(targetID int, alertType string) string {
+	switch alertType {
+	case "device_down", "device_up":
+		return fmt.Sprintf("auspex-target-%d", targetID)
+	case "cert_renewed":
+		alertType = "cert_expiry"
+	}
+	return fmt.Sprintf("auspex-target-%d-%s", targetID, alertType)
+}
+
+// isRecovery reports whether an alert type announces that an earlier alert
+// has cleared
+func isRecovery(alertType string) bool {
+	return alertType == "device_up" || alertType == "cert_renewed"
+}
+
 func sendSlackEmailAlert(channel AlertChannel, pollResult *PollResult, alertType, message, severity string) error {
 	// Get Slack email from config
 	slackEmail, ok := channel.Config["email"].(string)
@@ -514,7 +1147,7 @@ func sendSlackEmailAlert(channel AlertChannel, pollResult *PollResult, alertType
 	subject := fmt.Sprintf("[%s] Auspex Alert: %s", strings.ToUpper(severity), pollResult.TargetName)
 
 	emoji := "🔴"
-	if alertType == "device_up" {
+	if isRecovery(alertType) {
 		emoji = "✅"
 	}
 
@@ -532,7 +1165,7 @@ Auspex SNMP Monitor
 `, emoji, message, pollResult.TargetName, pollResult.Host,
 		strings.ToUpper(pollResult.Status),
 		time.Now().Format("2006-01-02 15:04:05 MST"),
-		pollResult.Message)
+		formatPollDetails(pollResult))
 
 	return sendEmail(fromEmail, slackEmail, subject, body)
 }
@@ -553,7 +1186,7 @@ func sendEmailAlert(channel AlertChannel, pollResult *PollResult, alertType, mes
 	subject := fmt.Sprintf("[%s] Auspex Alert: %s", strings.ToUpper(severity), pollResult.TargetName)
 
 	emoji := "🔴"
-	if alertType == "device_up" {
+	if isRecovery(alertType) {
 		emoji = "✅"
 	}
 
@@ -574,11 +1207,35 @@ View Target: http://localhost:8080/target.html?id=%d
 `, emoji, message, pollResult.TargetName, pollResult.Host,
 		strings.ToUpper(pollResult.Status), pollResult.LatencyMs,
 		time.Now().Format("2006-01-02 15:04:05 MST"),
-		pollResult.Message, pollResult.TargetID)
+		formatPollDetails(pollResult), pollResult.TargetID)
 
 	return sendEmail(fromEmail, toEmail, subject, body)
 }
 
+// formatPollDetails renders the error and collected values of a poll as
+// "key: value" lines for notification bodies
+func formatPollDetails(pollResult *PollResult) string {
+	if pollResult.Data == nil {
+		return pollResult.Reason()
+	}
+
+	var lines []string
+	if pollResult.Error != "" {
+		lines = append(lines, "error: "+pollResult.Error)
+	}
+
+	keys := make([]string, 0, len(pollResult.Data))
+	for k := range pollResult.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %v", k, pollResult.Data[k]))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
 func sendEmail(from, to, subject, body string) error {
 	if smtpHost == "" || smtpUser == "" || smtpPassword == "" {
 		return fmt.Errorf("SMTP not configured (check AUSPEX_SMTP_* environment variables)")
@@ -628,7 +1285,7 @@ func logDelivery(alertID int64, channel AlertChannel, pollResult *PollResult, st
 
 func loadAlertRules() ([]AlertRule, error) {
 	rows, err := db.Query(`
-		SELECT id, target_id, name, rule_type, severity, enabled, channels
+		SELECT id, target_id, name, rule_type, severity, enabled, channels, params
 		FROM alert_rules
 		WHERE enabled = true
 	`)
@@ -643,7 +1300,7 @@ func loadAlertRules() ([]AlertRule, error) {
 		var channelsArray string
 
 		err := rows.Scan(&rule.ID, &rule.TargetID, &rule.Name, &rule.RuleType,
-			&rule.Severity, &rule.Enabled, &channelsArray)
+			&rule.Severity, &rule.Enabled, &channelsArray, &rule.Params)
 		if err != nil {
 			return nil, err
 		}
@@ -716,15 +1373,18 @@ func loadAlertChannels(channelIDs []int) ([]AlertChannel, error) {
 
 func getLatestPollResult(targetID int) (*PollResult, error) {
 	var result PollResult
+	var dataJSON []byte
 	err := db.QueryRow(`
-		SELECT pr.target_id, t.name, t.host, pr.status, pr.latency_ms, pr.message, pr.polled_at
+		SELECT pr.target_id, t.name, t.host, pr.status, pr.latency_ms,
+		       COALESCE(pr.message, ''), COALESCE(pr.error, ''), pr.data, pr.polled_at
 		FROM poll_results pr
 		JOIN targets t ON t.id = pr.target_id
 		WHERE pr.target_id = $1
 		ORDER BY pr.polled_at DESC
 		LIMIT 1
 	`, targetID).Scan(&result.TargetID, &result.TargetName, &result.Host,
-		&result.Status, &result.LatencyMs, &result.Message, &result.PolledAt)
+		&result.Status, &result.LatencyMs, &result.Message, &result.Error, &dataJSON,
+		&result.PolledAt)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -733,9 +1393,174 @@ func getLatestPollResult(targetID int) (*PollResult, error) {
 		return nil, err
 	}
 
+	if dataJSON != nil {
+		// Keep numbers as json.Number so counters and uptimes print exactly
+		dec := json.NewDecoder(bytes.NewReader(dataJSON))
+		dec.UseNumber()
+		if err := dec.Decode(&result.Data); err != nil {
+			log.Printf("WARNING: failed to parse poll data for target %d: %v", targetID, err)
+		}
+	}
+
 	return &result, nil
 }
 
+// getTargetPollResult returns the latest poll result of a target, or a
+// placeholder with only its name and host when it has not been polled yet
+// (traps can arrive before the first poll)
+func getTargetPollResult(targetID int) (*PollResult, error) {
+	result, err := getLatestPollResult(targetID)
+	if err != nil || result != nil {
+		return result, err
+	}
+
+	result = &PollResult{TargetID: targetID, Status: "unknown"}
+	err = db.QueryRow(`
+		SELECT name, host FROM targets WHERE id = $1
+	`, targetID).Scan(&result.TargetName, &result.Host)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func loadRebootEvents(targetID int, afterID int64) ([]RebootEvent, error) {
+	rows, err := db.Query(`
+		SELECT id, target_id, boot_time::timestamptz, previous_uptime, current_uptime,
+		       detected_at::timestamptz
+		FROM reboot_events
+		WHERE target_id = $1 AND id > $2
+		ORDER BY id
+	`, targetID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []RebootEvent
+	for rows.Next() {
+		var ev RebootEvent
+		if err := rows.Scan(&ev.ID, &ev.TargetID, &ev.BootTime, &ev.PreviousUptime,
+			&ev.CurrentUptime, &ev.DetectedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+
+	return events, rows.Err()
+}
+
+func loadTraps(targetID int, afterID int64) ([]SNMPTrap, error) {
+	rows, err := db.Query(`
+		SELECT id, target_id, source_address, snmp_version, pdu_type, trap_oid,
+		       COALESCE(trap_name, ''), varbinds, received_at
+		FROM snmp_traps
+		WHERE target_id = $1 AND id > $2
+		ORDER BY id
+	`, targetID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var traps []SNMPTrap
+	for rows.Next() {
+		var trap SNMPTrap
+		var varbinds []byte
+		if err := rows.Scan(&trap.ID, &trap.TargetID, &trap.Source, &trap.Version, &trap.PDUType,
+			&trap.TrapOID, &trap.TrapName, &varbinds, &trap.ReceivedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(varbinds, &trap.Varbinds); err != nil {
+			return nil, fmt.Errorf("trap %d varbinds: %v", trap.ID, err)
+		}
+		traps = append(traps, trap)
+	}
+
+	return traps, rows.Err()
+}
+
+// loadCurrentCertificates returns the certificate chain the target served
+// in its latest "http" poll that saw one
+func loadCurrentCertificates(targetID int) ([]TLSCertificate, error) {
+	rows, err := db.Query(`
+		SELECT fingerprint_sha256, chain_position, subject, issuer, not_after::timestamptz
+		FROM tls_certificates
+		WHERE target_id = $1
+		  AND last_seen = (SELECT MAX(last_seen) FROM tls_certificates WHERE target_id = $1)
+		ORDER BY chain_position
+	`, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var certs []TLSCertificate
+	for rows.Next() {
+		var cert TLSCertificate
+		if err := rows.Scan(&cert.Fingerprint, &cert.ChainPosition, &cert.Subject,
+			&cert.Issuer, &cert.NotAfter); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, rows.Err()
+}
+
+// loadCertExpiryAlerts maps the certificates a cert_expiry rule has alerted
+// on to their alert_history IDs
+func loadCertExpiryAlerts(ruleID int) (map[string]*int64, error) {
+	rows, err := db.Query(`
+		SELECT fingerprint_sha256, alert_id FROM alert_cert_expiry WHERE rule_id = $1
+	`, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerted := make(map[string]*int64)
+	for rows.Next() {
+		var fingerprint string
+		var alertID *int64
+		if err := rows.Scan(&fingerprint, &alertID); err != nil {
+			return nil, err
+		}
+		alerted[fingerprint] = alertID
+	}
+
+	return alerted, rows.Err()
+}
+
+// getRuleCursor returns the last event ID processed by an event-based rule
+func getRuleCursor(ruleID int) (int64, bool, error) {
+	var cursor int64
+	err := db.QueryRow(`
+		SELECT last_event_id FROM alert_rule_cursors WHERE rule_id = $1
+	`, ruleID).Scan(&cursor)
+
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return cursor, true, nil
+}
+
+func saveRuleCursor(ruleID int, lastEventID int64) error {
+	_, err := db.Exec(`
+		INSERT INTO alert_rule_cursors (rule_id, last_event_id, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (rule_id) DO UPDATE
+		SET last_event_id = EXCLUDED.last_event_id,
+		    updated_at = EXCLUDED.updated_at
+	`, ruleID, lastEventID)
+
+	return err
+}
+
 func getAlertState(targetID int) (*AlertState, error) {
 	var state AlertState
 	err := db.QueryRow(`
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// pollCycle counts the polls the scheduler starts in one reload period
+// (AUSPEX_POLL_INTERVAL_SECONDS). When the period is over and the last of
+// its polls has finished, it is written to poll_cycles. A duration well past
+// the interval, or targets being skipped, means the poller is saturated.
+type pollCycle struct {
+    start     time.Time
+    interval  time.Duration
+    attempted int // polls started, only touched by the scheduler
+    skipped   int // due targets still in flight from an earlier poll
+    failed    atomic.Int32
+    polls     sync.WaitGroup
+}
+
+func newPollCycle(interval time.Duration) *pollCycle {
+    return &pollCycle{start: time.Now(), interval: interval}
+}
+
+// record waits for the cycle's polls to finish and writes it to
+// poll_cycles. No poll may be added to c once record has been called.
+func (c *pollCycle) record(db *sql.DB) {
+    c.polls.Wait()
+    duration := time.Since(c.start)
+    failed := int(c.failed.Load())
+
+    log.Printf("poll cycle: %d attempted, %d skipped, %d failed in %v",
+        c.attempted, c.skipped, failed, duration.Round(time.Millisecond))
+    if c.skipped > 0 {
+        log.Printf("warning: poller is saturated, %d targets were skipped", c.skipped)
+    }
+
+    _, err := db.Exec(
+        `INSERT INTO poll_cycles (poller_id, started_at, duration_ms, interval_seconds, attempted, skipped, failed)
+         VALUES ($1, $2::timestamptz, $3, $4, $5, $6, $7)`,
+        pollerID, c.start, duration.Milliseconds(), int(c.interval.Seconds()), c.attempted, c.skipped, failed,
+    )
+    if err != nil {
+        log.Printf("error recording poll cycle: %v", err)
+    }
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+    "database/sql"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/netip"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "text/tabwriter"
+    "time"
+
+    "auspex/internal/snmpv3"
+)
+
+// maxDiscoverHosts caps the number of addresses a single CIDR may expand to.
+const maxDiscoverHosts = 1 << 16
+
+// discovered is one address that answered an SNMP probe.
+type discovered struct {
+    Addr        netip.Addr
+    Cred        Target // credentials that worked (SNMP fields only)
+    CredLabel   string
+    SysName     string
+    SysObjectID string
+    Inventory   Inventory
+    Action      string // "add", "skip (host exists)", ...
+}
+
+// v3Creds collects repeated -v3 flags.
+type v3Creds []Target
+
+func (v *v3Creds) String() string { return fmt.Sprintf("%d credential(s)", len(*v)) }
+
+// Set parses user[:level[:authProto:authPass[:privProto:privPass]]].
+// Protocol aliases such as "sha256" or "aes" are stored under the names the
+// targets table allows.
+func (v *v3Creds) Set(s string) error {
+    parts := strings.Split(s, ":")
+    if parts[0] == "" {
+        return fmt.Errorf("missing security name")
+    }
+    t := Target{SNMPVersion: "3", SecurityName: parts[0], SecurityLevel: "noAuthNoPriv"}
+    if len(parts) > 1 {
+        t.SecurityLevel = parts[1]
+    }
+    if len(parts) > 3 {
+        auth, err := snmpv3.NormalizeAuthProtocol(parts[2])
+        if err != nil {
+            return err
+        }
+        t.AuthProtocol, t.AuthPassphrase = auth, parts[3]
+    }
+    if len(parts) > 5 {
+        priv, err := snmpv3.NormalizePrivProtocol(parts[4])
+        if err != nil {
+            return err
+        }
+        t.PrivProtocol, t.PrivPassphrase = priv, parts[5]
+    }
+    if _, _, err := newSNMPClient(t); err != nil {
+        return err
+    }
+    *v = append(*v, t)
+    return nil
+}
+
+// runDiscover implements "poller discover": probe every address in the given
+// CIDRs with each candidate credential and add responding devices as targets.
+func runDiscover(db *sql.DB, args []string) error {
+    fs := flag.NewFlagSet("discover", flag.ExitOnError)
+    communities := fs.String("community", "public", "comma-separated community strings to try")
+    version := fs.String("version", "2c", "SNMP version used with community strings (1 or 2c)")
+    var v3 v3Creds
+    fs.Var(&v3, "v3", "SNMPv3 credential user[:level[:authProto:authPass[:privProto:privPass]]] (repeatable)")
+    port := fs.Int("port", 161, "SNMP port")
+    timeout := fs.Duration("timeout", time.Second, "per-probe timeout")
+    concurrency := fs.Int("concurrency", 64, "maximum concurrent probes")
+    dryRun := fs.Bool("dry-run", false, "report what would be added without writing to the database")
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "usage: poller discover [flags] CIDR [CIDR...]\n\n")
+        fs.PrintDefaults()
+    }
+    fs.Parse(args)
+
+    if fs.NArg() == 0 {
+        fs.Usage()
+        return fmt.Errorf("at least one CIDR is required")
+    }
+    if *version != "1" && *version != "2c" {
+        return fmt.Errorf("-version must be 1 or 2c")
+    }
+    if *concurrency <= 0 {
+        *concurrency = 1
+    }
+
+    var addrs []netip.Addr
+    for _, cidr := range fs.Args() {
+        hosts, err := expandCIDR(cidr)
+        if err != nil {
+            return err
+        }
+        addrs = append(addrs, hosts...)
+    }
+
+    var creds []Target
+    for _, c := range strings.Split(*communities, ",") {
+        if c = strings.TrimSpace(c); c != "" {
+            creds = append(creds, Target{SNMPVersion: *version, Community: c})
+        }
+    }
+    creds = append(creds, v3...)
+    if len(creds) == 0 {
+        return fmt.Errorf("no credentials to try")
+    }
+
+    log.Printf("discovering %d addresses with %d credential(s) (concurrency=%d)",
+        len(addrs), len(creds), *concurrency)
+
+    found := probeAll(addrs, creds, *port, *timeout, *concurrency)
+
+    fingerprints, err := loadFingerprints(db)
+    if err != nil {
+        log.Printf("error loading device fingerprints, using builtin list: %v", err)
+        fingerprints = newFingerprintDB(builtinFingerprints)
+    }
+    for i := range found {
+        fingerprints.Identify(&found[i].Inventory)
+    }
+
+    if err := planDiscovered(db, found); err != nil {
+        return err
+    }
+
+    added := 0
+    if !*dryRun {
+        for i := range found {
+            if found[i].Action != "add" {
+                continue
+            }
+            if err := insertDiscovered(db, found[i], *port); err != nil {
+                found[i].Action = "error: " + err.Error()
+                continue
+            }
+            added++
+        }
+    }
+
+    printDiscoverReport(os.Stdout, found, *dryRun)
+    log.Printf("discovery finished: %d responding, %d added", len(found), added)
+    return nil
+}
+
+// expandCIDR returns the host addresses of a prefix, skipping the network
+// and broadcast addresses of IPv4 prefixes shorter than /31.
+func expandCIDR(cidr string) ([]netip.Addr, error) {
+    prefix, err := netip.ParsePrefix(cidr)
+    if err != nil {
+        if addr, aerr := netip.ParseAddr(cidr); aerr == nil {
+            return []netip.Addr{addr}, nil
+        }
+        return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+    }
+    prefix = prefix.Masked()
+
+    hostBits := prefix.Addr().BitLen() - prefix.Bits()
+    if hostBits > 16 {
+        return nil, fmt.Errorf("CIDR %s is larger than %d addresses", cidr, maxDiscoverHosts)
+    }
+
+    var hosts []netip.Addr
+    for a := prefix.Addr(); prefix.Contains(a); a = a.Next() {
+        hosts = append(hosts, a)
+        if !a.Next().IsValid() {
+            break
+        }
+    }
+    if prefix.Addr().Is4() && hostBits >= 2 {
+        hosts = hosts[1 : len(hosts)-1]
+    }
+    return hosts, nil
+}
+
+// probeAll probes every address concurrently, at most maxConcurrent at a
+// time, and returns the responders sorted by address.
+func probeAll(addrs []netip.Addr, creds []Target, port int, timeout time.Duration, maxConcurrent int) []discovered {
+    sem := make(chan struct{}, maxConcurrent)
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var found []discovered
+
+    for _, a := range addrs {
+        wg.Add(1)
+        sem <- struct{}{}
+
+        go func(a netip.Addr) {
+            defer wg.Done()
+            defer func() { <-sem }()
+
+            if d, ok := probeAddr(a, creds, port, timeout); ok {
+                mu.Lock()
+                found = append(found, d)
+                mu.Unlock()
+            }
+        }(a)
+    }
+
+    wg.Wait()
+
+    sort.Slice(found, func(i, j int) bool { return found[i].Addr.Less(found[j].Addr) })
+    return found
+}
+
+// probeAddr tries each credential in turn and returns the first that gets
+// an answer for sysName/sysObjectID.
+func probeAddr(a netip.Addr, creds []Target, port int, timeout time.Duration) (discovered, bool) {
+    oids := []string{
+        "1.3.6.1.2.1.1.5.0", // sysName
+        "1.3.6.1.2.1.1.2.0", // sysObjectID
+        "1.3.6.1.2.1.1.1.0", // sysDescr
+    }
+
+    for _, cred := range creds {
+        t := cred
+        t.Host = a.String()
+        t.Port = port
+
+        g, _, err := newSNMPClient(t)
+        if err != nil {
+            continue
+        }
+        g.Timeout = timeout
+        g.Retries = 0
+
+        if err := g.Connect(); err != nil {
+            continue
+        }
+        vars, err := snmpGet(g, oids)
+        g.Conn.Close()
+        if err != nil {
+            continue
+        }
+
+        d := discovered{Addr: a, Cred: cred, CredLabel: credLabel(cred)}
+        d.SysName = snmpValueToString(vars[0])
+        d.SysObjectID = strings.TrimPrefix(snmpValueToString(vars[1]), ".")
+        d.Inventory = Inventory{SysName: d.SysName, SysObjectID: d.SysObjectID,
+            SysDescr: snmpValueToString(vars[2])}
+        if d.SysName == "" && d.SysObjectID == "" {
+            continue
+        }
+        return d, true
+    }
+    return discovered{}, false
+}
+
+// credLabel describes a credential without revealing secrets.
+func credLabel(t Target) string {
+    if t.SNMPVersion == "3" {
+        return fmt.Sprintf("v3 user=%s", t.SecurityName)
+    }
+    c := t.Community
+    if len(c) > 2 {
+        c = c[:2] + strings.Repeat("*", len(c)-2)
+    }
+    return fmt.Sprintf("v%s community=%s", t.SNMPVersion, c)
+}
+
+// planDiscovered decides for each responder whether it is new. Devices are
+// skipped when their address is already a target host, or when their
+// sysName matches an existing target (by name or inventory sysName) or an
+// earlier responder in this run (multi-homed devices).
+func planDiscovered(db *sql.DB, found []discovered) error {
+    hosts := make(map[string]bool)
+    names := make(map[string]bool)
+
+    rows, err := db.Query(`
+        SELECT t.host, t.name, COALESCE(i.sys_name, '')
+        FROM targets t
+        LEFT JOIN device_inventory i ON i.target_id = t.id`)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var host, name, sysName string
+        if err := rows.Scan(&host, &name, &sysName); err != nil {
+            return err
+        }
+        hosts[host] = true
+        if ip := net.ParseIP(host); ip != nil {
+            hosts[ip.String()] = true
+        }
+        names[strings.ToLower(name)] = true
+        if sysName != "" {
+            names[strings.ToLower(sysName)] = true
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for i := range found {
+        d := &found[i]
+        key := strings.ToLower(d.SysName)
+        switch {
+        case hosts[d.Addr.String()]:
+            d.Action = "skip (host exists)"
+        case key != "" && names[key]:
+            d.Action = "skip (sysName exists)"
+        default:
+            d.Action = "add"
+            if key != "" {
+                names[key] = true
+            }
+        }
+    }
+    return nil
+}
+
+// insertDiscovered adds a responder to targets with the credential that worked.
+func insertDiscovered(db *sql.DB, d discovered, port int) error {
+    name := d.SysName
+    if name == "" {
+        name = d.Addr.String()
+    }
+
+    nullable := func(s string) interface{} {
+        if s == "" {
+            return nil
+        }
+        return s
+    }
+
+    c := d.Cred
+    community := c.Community
+    if community == "" {
+        community = "public"
+    }
+
+    _, err := db.Exec(`
+        INSERT INTO targets (name, host, port, community, snmp_version,
+                             snmp_security_name, snmp_security_level,
+                             snmp_auth_protocol, snmp_auth_passphrase,
+                             snmp_priv_protocol, snmp_priv_passphrase, enabled)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, true)`,
+        name, d.Addr.String(), port, community, c.SNMPVersion,
+        nullable(c.SecurityName), nullable(c.SecurityLevel),
+        nullable(c.AuthProtocol), nullable(c.AuthPassphrase),
+        nullable(c.PrivProtocol), nullable(c.PrivPassphrase))
+    return err
+}
+
+func printDiscoverReport(out io.Writer, found []discovered, dryRun bool) {
+    if dryRun {
+        fmt.Fprintln(out, "DRY RUN - no targets were added")
+    }
+
+    w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "ADDRESS\tSYSNAME\tSYSOBJECTID\tVENDOR\tCREDENTIAL\tACTION")
+    for _, d := range found {
+        vendor := strings.TrimSpace(d.Inventory.Vendor + " " + d.Inventory.ModelFamily)
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+            d.Addr, d.SysName, d.SysObjectID, vendor, d.CredLabel, d.Action)
+    }
+    w.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "net/netip"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestExpandCIDR(t *testing.T) {
+    addrs := func(ss ...string) []netip.Addr {
+        var out []netip.Addr
+        for _, s := range ss {
+            out = append(out, netip.MustParseAddr(s))
+        }
+        return out
+    }
+    tests := []struct {
+        cidr    string
+        want    []netip.Addr
+        wantErr string
+    }{
+        {cidr: "10.0.0.0/30", want: addrs("10.0.0.1", "10.0.0.2")},
+        {cidr: "10.0.0.7/30", want: addrs("10.0.0.5", "10.0.0.6")},
+        {cidr: "10.0.0.0/31", want: addrs("10.0.0.0", "10.0.0.1")},
+        {cidr: "10.0.0.9/32", want: addrs("10.0.0.9")},
+        {cidr: "10.0.0.5", want: addrs("10.0.0.5")},
+        {cidr: "255.255.255.252/30", want: addrs("255.255.255.253", "255.255.255.254")},
+        {cidr: "2001:db8::/126", want: addrs("2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3")},
+        {cidr: "2001:db8::1", want: addrs("2001:db8::1")},
+        {cidr: "10.0.0.0/15", wantErr: "larger than 65536 addresses"},
+        {cidr: "2001:db8::/64", wantErr: "larger than 65536 addresses"},
+        {cidr: "bogus", wantErr: "invalid CIDR"},
+        {cidr: "10.0.0.0/33", wantErr: "invalid CIDR"},
+    }
+    for _, tt := range tests {
+        got, err := expandCIDR(tt.cidr)
+        if tt.wantErr != "" {
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("expandCIDR(%q) error = %v, want %q", tt.cidr, err, tt.wantErr)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("expandCIDR(%q): %v", tt.cidr, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("expandCIDR(%q) = %v, want %v", tt.cidr, got, tt.want)
+        }
+    }
+
+    got, err := expandCIDR("10.1.0.0/16")
+    if err != nil || len(got) != maxDiscoverHosts-2 {
+        t.Errorf("expandCIDR(10.1.0.0/16) = %d addresses, %v; want %d", len(got), err, maxDiscoverHosts-2)
+    }
+}
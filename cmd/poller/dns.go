@@ -0,0 +1,285 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "os"
+    "strings"
+    "time"
+
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+func init() {
+    registerProber("dns", dnsProber{})
+}
+
+// dnsParams are the check_params of a "dns" target. The target's host is the
+// resolver being checked unless server is set.
+type dnsParams struct {
+    Name      string   `json:"name"`       // name to look up, e.g. "intranet.example.com"
+    Type      string   `json:"type"`       // A, AAAA, CNAME, MX, TXT or SOA
+    Server    string   `json:"server"`     // resolver host[:port], default the target's host on port 53
+    Expect    []string `json:"expect"`     // answers that must all be present
+    MinSerial uint32   `json:"min_serial"` // SOA only: lowest acceptable serial
+    TimeoutMs int      `json:"timeout_ms"` // per attempt, UDP and the TCP retry
+    TCP       bool     `json:"tcp"`        // query over TCP instead of UDP
+    Recursion bool     `json:"recursion"`  // set RD; false for authoritative-only servers
+}
+
+var dnsTypes = map[string]dnsmessage.Type{
+    "A":     dnsmessage.TypeA,
+    "AAAA":  dnsmessage.TypeAAAA,
+    "CNAME": dnsmessage.TypeCNAME,
+    "MX":    dnsmessage.TypeMX,
+    "TXT":   dnsmessage.TypeTXT,
+    "SOA":   dnsmessage.TypeSOA,
+}
+
+// dnsProber sends one query to a resolver and checks the answer. Latency is
+// the response time of the query (of the TCP retry when the UDP answer was
+// truncated).
+type dnsProber struct{}
+
+func (dnsProber) Probe(ctx context.Context, t Target) PollResult {
+    params := dnsParams{Type: "A", TimeoutMs: 2000, Recursion: true}
+    if err := decodeParams(t, &params); err != nil {
+        return downResult("%v", err)
+    }
+    if params.Name == "" {
+        return downResult("invalid check_params for dns check: name is required")
+    }
+    qtype, ok := dnsTypes[strings.ToUpper(params.Type)]
+    if !ok {
+        return downResult("invalid check_params for dns check: unsupported type %q", params.Type)
+    }
+    if params.MinSerial > 0 && qtype != dnsmessage.TypeSOA {
+        return downResult("invalid check_params for dns check: min_serial needs type SOA")
+    }
+
+    server := params.Server
+    if server == "" {
+        server = t.Host
+    }
+    if _, _, err := net.SplitHostPort(server); err != nil {
+        server = net.JoinHostPort(server, "53")
+    }
+
+    fqdn := params.Name
+    if !strings.HasSuffix(fqdn, ".") {
+        fqdn += "."
+    }
+    name, err := dnsmessage.NewName(fqdn)
+    if err != nil {
+        return downResult("invalid check_params for dns check: name %q: %v", params.Name, err)
+    }
+    query := fmt.Sprintf("%s %s", params.Name, strings.ToUpper(params.Type))
+
+    timeout := time.Duration(params.TimeoutMs) * time.Millisecond
+    transport := "udp"
+    if params.TCP {
+        transport = "tcp"
+    }
+    resp, rtt, err := dnsExchange(ctx, transport, server, name, qtype, params.Recursion, timeout)
+    if err == nil && resp.Truncated && transport == "udp" {
+        transport = "tcp"
+        resp, rtt, err = dnsExchange(ctx, transport, server, name, qtype, params.Recursion, timeout)
+    }
+    if err != nil {
+        return downResult("DNS %s via %s failed: %v", query, server, err)
+    }
+
+    answers, serial := dnsAnswers(resp, qtype)
+    values := map[string]interface{}{
+        "server":        server,
+        "query":         query,
+        "transport":     transport,
+        "rcode":         dnsRcodeName(resp.RCode),
+        "authoritative": resp.Authoritative,
+        "answers":       answers,
+        "answer_count":  len(answers),
+        "response_ms":   durationMs(rtt),
+    }
+    if qtype == dnsmessage.TypeSOA && len(answers) > 0 {
+        values["soa_serial"] = serial
+    }
+    down := func(format string, args ...interface{}) PollResult {
+        r := downResult(format, args...)
+        r.Data = values
+        return r
+    }
+
+    if resp.RCode != dnsmessage.RCodeSuccess {
+        return down("DNS %s via %s: %s", query, server, dnsRcodeName(resp.RCode))
+    }
+    if len(answers) == 0 {
+        return down("DNS %s via %s: no %s records", query, server, strings.ToUpper(params.Type))
+    }
+    if missing := missingAnswers(params.Expect, answers); len(missing) > 0 {
+        return down("DNS %s via %s: expected %s, got %s", query, server,
+            strings.Join(missing, ", "), strings.Join(answers, ", "))
+    }
+    if params.MinSerial > 0 && serial < params.MinSerial {
+        return down("DNS %s via %s: SOA serial %d is below %d", query, server, serial, params.MinSerial)
+    }
+
+    return PollResult{
+        Status:    "up",
+        LatencyMs: int(rtt.Milliseconds()),
+        Message: fmt.Sprintf("DNS %s via %s in %.2f ms: %s", query, server, durationMs(rtt),
+            truncate(strings.Join(answers, ", "), 200)),
+        Data: values,
+    }
+}
+
+// dnsExchange sends a single question to server and waits for the matching
+// response. UDP replies with another ID (late answers to an earlier query)
+// are skipped until the deadline.
+func dnsExchange(ctx context.Context, network, server string, name dnsmessage.Name, qtype dnsmessage.Type, recursion bool, timeout time.Duration) (*dnsmessage.Message, time.Duration, error) {
+    id := uint16(rand.Intn(1 << 16))
+    query := dnsmessage.Message{
+        Header:    dnsmessage.Header{ID: id, RecursionDesired: recursion},
+        Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+    }
+    packed, err := query.Pack()
+    if err != nil {
+        return nil, 0, err
+    }
+
+    start := time.Now()
+    conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, network, server)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer conn.Close()
+    if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+        return nil, 0, err
+    }
+
+    if network == "tcp" {
+        // RFC 1035 4.2.2: messages over TCP carry a two byte length prefix
+        packed = append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...)
+    }
+    if _, err := conn.Write(packed); err != nil {
+        return nil, 0, err
+    }
+
+    for {
+        var buf []byte
+        if network == "tcp" {
+            var size [2]byte
+            if _, err := io.ReadFull(conn, size[:]); err != nil {
+                return nil, 0, dnsReadError(err)
+            }
+            buf = make([]byte, binary.BigEndian.Uint16(size[:]))
+            if _, err := io.ReadFull(conn, buf); err != nil {
+                return nil, 0, dnsReadError(err)
+            }
+        } else {
+            buf = make([]byte, 65535)
+            n, err := conn.Read(buf)
+            if err != nil {
+                return nil, 0, dnsReadError(err)
+            }
+            buf = buf[:n]
+        }
+        rtt := time.Since(start)
+
+        var resp dnsmessage.Message
+        if err := resp.Unpack(buf); err != nil {
+            if network == "tcp" {
+                return nil, 0, fmt.Errorf("malformed response: %v", err)
+            }
+            continue
+        }
+        if resp.ID != id || !resp.Response {
+            if network == "tcp" {
+                return nil, 0, fmt.Errorf("response ID %d does not match query ID %d", resp.ID, id)
+            }
+            continue
+        }
+        return &resp, rtt, nil
+    }
+}
+
+func dnsReadError(err error) error {
+    if errors.Is(err, os.ErrDeadlineExceeded) {
+        return fmt.Errorf("timed out")
+    }
+    return err
+}
+
+// dnsAnswers formats the answer records of the queried type, ignoring
+// others such as the CNAMEs leading to an A record. Names are lower-case
+// without the trailing dot; MX records read "preference host". For SOA the
+// serial of the first record is returned as well.
+func dnsAnswers(resp *dnsmessage.Message, qtype dnsmessage.Type) ([]string, uint32) {
+    answers := []string{}
+    var serial uint32
+    for _, rr := range resp.Answers {
+        if rr.Header.Type != qtype {
+            continue
+        }
+        switch body := rr.Body.(type) {
+        case *dnsmessage.AResource:
+            answers = append(answers, net.IP(body.A[:]).String())
+        case *dnsmessage.AAAAResource:
+            answers = append(answers, net.IP(body.AAAA[:]).String())
+        case *dnsmessage.CNAMEResource:
+            answers = append(answers, dnsName(body.CNAME))
+        case *dnsmessage.MXResource:
+            answers = append(answers, fmt.Sprintf("%d %s", body.Pref, dnsName(body.MX)))
+        case *dnsmessage.TXTResource:
+            answers = append(answers, strings.Join(body.TXT, ""))
+        case *dnsmessage.SOAResource:
+            if len(answers) == 0 {
+                serial = body.Serial
+            }
+            answers = append(answers, fmt.Sprintf("%s %s %d", dnsName(body.NS), dnsName(body.MBox), body.Serial))
+        }
+    }
+    return answers, serial
+}
+
+func dnsName(n dnsmessage.Name) string {
+    return strings.ToLower(strings.TrimSuffix(n.String(), "."))
+}
+
+// missingAnswers returns the expected answers that are not in got. Names
+// compare case-insensitively and with or without the trailing dot.
+func missingAnswers(expect, got []string) []string {
+    have := make(map[string]bool, len(got))
+    for _, a := range got {
+        have[a] = true
+    }
+    var missing []string
+    for _, e := range expect {
+        if !have[e] && !have[strings.ToLower(strings.TrimSuffix(e, "."))] {
+            missing = append(missing, e)
+        }
+    }
+    return missing
+}
+
+func dnsRcodeName(rc dnsmessage.RCode) string {
+    switch rc {
+    case dnsmessage.RCodeSuccess:
+        return "NOERROR"
+    case dnsmessage.RCodeFormatError:
+        return "FORMERR"
+    case dnsmessage.RCodeServerFailure:
+        return "SERVFAIL"
+    case dnsmessage.RCodeNameError:
+        return "NXDOMAIN"
+    case dnsmessage.RCodeNotImplemented:
+        return "NOTIMP"
+    case dnsmessage.RCodeRefused:
+        return "REFUSED"
+    }
+    return fmt.Sprintf("RCODE%d", rc)
+}
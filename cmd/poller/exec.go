@@ -0,0 +1,281 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+func init() {
+    registerProber("exec", execProber{})
+}
+
+// pluginDirs are the only directories exec checks may run commands from, so
+// write access to check_params does not mean running anything on the poller
+// host. Set from AUSPEX_PLUGIN_DIRS in main.
+var pluginDirs = []string{"/usr/lib/nagios/plugins", "/usr/lib64/nagios/plugins", "/usr/local/nagios/libexec"}
+
+// pluginPath is the PATH plugins run with; the poller's own environment
+// (database password included) is not passed on.
+const pluginPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// execParams are the check_params of an "exec" target.
+type execParams struct {
+    Command   []string          `json:"command"`    // plugin and arguments, e.g. ["check_http", "-H", "$HOSTADDRESS$"]
+    TimeoutMs int               `json:"timeout_ms"` // the plugin is killed and the check down after this
+    Env       map[string]string `json:"env"`        // extra environment variables
+}
+
+// pluginStates maps Nagios plugin exit codes to poll_results statuses.
+var pluginStates = map[int]string{0: "up", 1: "degraded", 2: "down", 3: "unknown"}
+
+// execProber runs a Nagios-compatible plugin. The exit code gives the
+// status, the first line of output the message, and performance data after
+// the "|" is stored in data as "perfdata". Latency is the plugin's run time.
+type execProber struct{}
+
+func (execProber) Probe(ctx context.Context, t Target) PollResult {
+    params := execParams{TimeoutMs: 10000}
+    if err := decodeParams(t, &params); err != nil {
+        return downResult("%v", err)
+    }
+    if len(params.Command) == 0 {
+        return downResult("invalid check_params for exec check: command is required")
+    }
+
+    path, err := resolvePlugin(params.Command[0])
+    if err != nil {
+        return PollResult{Status: "unknown", Message: err.Error(), Error: err.Error()}
+    }
+    macros := strings.NewReplacer(
+        "$HOSTADDRESS$", t.Host,
+        "$HOSTNAME$", t.Name,
+        "$PORT$", strconv.Itoa(t.Port),
+    )
+    args := make([]string, len(params.Command)-1)
+    for i, a := range params.Command[1:] {
+        args[i] = macros.Replace(a)
+    }
+
+    timeout := time.Duration(params.TimeoutMs) * time.Millisecond
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, path, args...)
+    cmd.Env = []string{pluginPath}
+    for k, v := range params.Env {
+        cmd.Env = append(cmd.Env, k+"="+macros.Replace(v))
+    }
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    // Do not wait for grandchildren that keep the output pipes open
+    cmd.WaitDelay = time.Second
+
+    start := time.Now()
+    err = cmd.Run()
+    elapsed := time.Since(start)
+    name := filepath.Base(path)
+
+    if ctx.Err() == context.DeadlineExceeded {
+        return downResult("%s timed out after %v", name, timeout)
+    }
+    code := 0
+    if err != nil {
+        var exitErr *exec.ExitError
+        if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+            msg := fmt.Sprintf("%s failed: %v", name, err)
+            return PollResult{Status: "unknown", Message: msg, Error: msg}
+        }
+        code = exitErr.ExitCode()
+    }
+
+    output := stdout.String()
+    if strings.TrimSpace(output) == "" {
+        output = stderr.String()
+    }
+    text, long, perf := parsePluginOutput(output)
+    if text == "" {
+        text = fmt.Sprintf("%s returned no output", name)
+    }
+
+    values := map[string]interface{}{
+        "exit_code":   code,
+        "duration_ms": durationMs(elapsed),
+    }
+    if long != "" {
+        values["long_output"] = truncate(long, 4096)
+    }
+    if perfdata := parsePerfdata(perf); len(perfdata) > 0 {
+        values["perfdata"] = perfdata
+    }
+
+    status, ok := pluginStates[code]
+    if !ok {
+        status = "unknown"
+        text = fmt.Sprintf("%s exit code %d is out of bounds: %s", name, code, text)
+    }
+    result := PollResult{
+        Status:    status,
+        LatencyMs: int(elapsed.Milliseconds()),
+        Message:   truncate(text, 1024),
+        Data:      values,
+    }
+    if status != "up" {
+        result.Error = result.Message
+    }
+    return result
+}
+
+// resolvePlugin finds a plugin by name in pluginDirs, or checks that an
+// absolute path lies inside one of them.
+func resolvePlugin(command string) (string, error) {
+    if filepath.IsAbs(command) {
+        path := filepath.Clean(command)
+        for _, dir := range pluginDirs {
+            if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+                return path, nil
+            }
+        }
+        return "", fmt.Errorf("plugin %s is outside AUSPEX_PLUGIN_DIRS (%s)", command, strings.Join(pluginDirs, ":"))
+    }
+    if strings.ContainsRune(command, filepath.Separator) {
+        return "", fmt.Errorf("plugin %q must be a name or an absolute path", command)
+    }
+    for _, dir := range pluginDirs {
+        path := filepath.Join(dir, command)
+        if info, err := os.Stat(path); err == nil && !info.IsDir() {
+            return path, nil
+        }
+    }
+    return "", fmt.Errorf("plugin %s not found in AUSPEX_PLUGIN_DIRS (%s)", command, strings.Join(pluginDirs, ":"))
+}
+
+// parsePluginOutput splits plugin output into the first line of text, the
+// long output that follows it and the performance data. As in Nagios 3+,
+// perfdata follows a "|" on the first line and on the first long output
+// line that contains one, and every line after that is perfdata too.
+func parsePluginOutput(out string) (text, long, perf string) {
+    lines := strings.Split(strings.TrimRight(out, "\r\n"), "\n")
+    var longLines, perfParts []string
+
+    text = lines[0]
+    if i := strings.Index(text, "|"); i >= 0 {
+        perfParts = append(perfParts, text[i+1:])
+        text = text[:i]
+    }
+
+    inPerf := false
+    for _, l := range lines[1:] {
+        if inPerf {
+            perfParts = append(perfParts, l)
+            continue
+        }
+        if i := strings.Index(l, "|"); i >= 0 {
+            longLines = append(longLines, l[:i])
+            perfParts = append(perfParts, l[i+1:])
+            inPerf = true
+            continue
+        }
+        longLines = append(longLines, l)
+    }
+
+    return strings.TrimSpace(text), strings.TrimSpace(strings.Join(longLines, "\n")), strings.Join(perfParts, " ")
+}
+
+// parsePerfdata parses Nagios performance data,
+//
+//  'label'=value[UOM];[warn];[crit];[min];[max] ...
+//
+// into label -> {"value", "uom", "warn", "crit", "min", "max"}, leaving out
+// empty fields. value, min and max are numbers; warn and crit stay strings
+// as they may be ranges such as "@10:20". A value of "U" (unknown) is left
+// out. Malformed entries are skipped.
+func parsePerfdata(s string) map[string]interface{} {
+    metrics := make(map[string]interface{})
+    for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+        var label string
+        if s[0] == '\'' {
+            // Quoted label; '' stands for a literal quote
+            i := 1
+            for ; i < len(s); i++ {
+                if s[i] == '\'' {
+                    if i+1 < len(s) && s[i+1] == '\'' {
+                        label += "'"
+                        i++
+                        continue
+                    }
+                    break
+                }
+                label += string(s[i])
+            }
+            s = s[min(i+1, len(s)):]
+        } else {
+            end := strings.IndexAny(s, "= ")
+            if end < 0 {
+                break
+            }
+            label, s = s[:end], s[end:]
+        }
+
+        end := strings.IndexAny(s, " \t")
+        if end < 0 {
+            end = len(s)
+        }
+        field := s[:end]
+        s = s[end:]
+        if label == "" || !strings.HasPrefix(field, "=") {
+            continue
+        }
+
+        parts := strings.Split(field[1:], ";")
+        m := make(map[string]interface{})
+        if parts[0] != "U" {
+            num, uom := splitPerfValue(parts[0])
+            v, err := strconv.ParseFloat(num, 64)
+            if err != nil {
+                continue
+            }
+            m["value"] = v
+            if uom != "" {
+                m["uom"] = uom
+            }
+        }
+        for i, key := range []string{"warn", "crit", "min", "max"} {
+            if i+1 >= len(parts) || parts[i+1] == "" {
+                continue
+            }
+            if key == "min" || key == "max" {
+                if v, err := strconv.ParseFloat(strings.Replace(parts[i+1], ",", ".", 1), 64); err == nil {
+                    m[key] = v
+                }
+                continue
+            }
+            m[key] = parts[i+1]
+        }
+        metrics[label] = m
+    }
+    return metrics
+}
+
+// splitPerfValue splits "12.5ms" into "12.5" and "ms". A decimal comma,
+// as written by plugins in some locales, becomes a point.
+func splitPerfValue(s string) (string, string) {
+    i := 0
+    for i < len(s) && strings.IndexByte("0123456789.,-+eE", s[i]) >= 0 {
+        // An "e" only belongs to the number when a digit follows ("1e3"),
+        // not in units such as "events"
+        if (s[i] == 'e' || s[i] == 'E') && (i+1 >= len(s) || strings.IndexByte("0123456789+-", s[i+1]) < 0) {
+            break
+        }
+        i++
+    }
+    return strings.Replace(s[:i], ",", ".", 1), s[i:]
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestPluginStates(t *testing.T) {
+    tests := []struct {
+        code int
+        want string
+    }{
+        {0, "up"},
+        {1, "degraded"},
+        {2, "down"},
+        {3, "unknown"},
+    }
+    for _, tt := range tests {
+        if got := pluginStates[tt.code]; got != tt.want {
+            t.Errorf("pluginStates[%d] = %q, want %q", tt.code, got, tt.want)
+        }
+    }
+    if _, ok := pluginStates[4]; ok {
+        t.Errorf("pluginStates[4] is set, want out-of-range codes left to the caller")
+    }
+}
+
+func TestParsePluginOutput(t *testing.T) {
+    tests := []struct {
+        name                 string
+        out                  string
+        text, long, perfdata string
+    }{
+        {
+            name: "text only",
+            out:  "OK - all good\n",
+            text: "OK - all good",
+        },
+        {
+            name:     "perfdata on first line",
+            out:      "PING OK - rta 1.2ms | rta=1.2ms;100;500;0 pl=0%;20;60;0\n",
+            text:     "PING OK - rta 1.2ms",
+            perfdata: " rta=1.2ms;100;500;0 pl=0%;20;60;0",
+        },
+        {
+            name:     "long output and perfdata",
+            out:      "DISK OK | /=10MB\n/ 10MB used\n/var 20MB used | /var=20MB\n/home=30MB\n",
+            text:     "DISK OK",
+            long:     "/ 10MB used\n/var 20MB used",
+            perfdata: " /=10MB  /var=20MB /home=30MB",
+        },
+        {
+            name: "CRLF line endings",
+            out:  "WARNING - slow\r\n",
+            text: "WARNING - slow",
+        },
+    }
+    for _, tt := range tests {
+        text, long, perfdata := parsePluginOutput(tt.out)
+        if text != tt.text || long != tt.long || perfdata != tt.perfdata {
+            t.Errorf("%s: parsePluginOutput = (%q, %q, %q), want (%q, %q, %q)",
+                tt.name, text, long, perfdata, tt.text, tt.long, tt.perfdata)
+        }
+    }
+}
+
+func TestParsePerfdata(t *testing.T) {
+    type m = map[string]interface{}
+    tests := []struct {
+        name string
+        in   string
+        want m
+    }{
+        {
+            name: "empty",
+            in:   "  ",
+            want: m{},
+        },
+        {
+            name: "value only",
+            in:   "users=3",
+            want: m{"users": m{"value": 3.0}},
+        },
+        {
+            name: "all fields with UOM",
+            in:   "rta=1.25ms;100;500;0;1000",
+            want: m{"rta": m{"value": 1.25, "uom": "ms", "warn": "100", "crit": "500", "min": 0.0, "max": 1000.0}},
+        },
+        {
+            name: "empty fields left out",
+            in:   "pl=0%;;60;;",
+            want: m{"pl": m{"value": 0.0, "uom": "%", "crit": "60"}},
+        },
+        {
+            name: "ranges stay strings",
+            in:   "temp=21C;@10:20;~:30",
+            want: m{"temp": m{"value": 21.0, "uom": "C", "warn": "@10:20", "crit": "~:30"}},
+        },
+        {
+            name: "quoted label with spaces and quote",
+            in:   "'free space'=10GB 'it''s'=1",
+            want: m{"free space": m{"value": 10.0, "uom": "GB"}, "it's": m{"value": 1.0}},
+        },
+        {
+            name: "unknown value",
+            in:   "load=U;5;10",
+            want: m{"load": m{"warn": "5", "crit": "10"}},
+        },
+        {
+            name: "decimal comma",
+            in:   "time=0,5s;;;0,0;1,5",
+            want: m{"time": m{"value": 0.5, "uom": "s", "min": 0.0, "max": 1.5}},
+        },
+        {
+            name: "exponent and unit starting with e",
+            in:   "big=1e3B rate=5events",
+            want: m{"big": m{"value": 1000.0, "uom": "B"}, "rate": m{"value": 5.0, "uom": "events"}},
+        },
+        {
+            name: "malformed entries skipped",
+            in:   "novalue ok=1 bad=abc =2",
+            want: m{"ok": m{"value": 1.0}},
+        },
+    }
+    for _, tt := range tests {
+        if got := parsePerfdata(tt.in); !reflect.DeepEqual(got, map[string]interface{}(tt.want)) {
+            t.Errorf("%s: parsePerfdata(%q) = %v, want %v", tt.name, tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestSplitPerfValue(t *testing.T) {
+    tests := []struct {
+        in, num, uom string
+    }{
+        {"12.5ms", "12.5", "ms"},
+        {"-3", "-3", ""},
+        {"1,5s", "1.5", "s"},
+        {"2E-3s", "2E-3", "s"},
+        {"7events", "7", "events"},
+        {"100%", "100", "%"},
+        {"", "", ""},
+    }
+    for _, tt := range tests {
+        num, uom := splitPerfValue(tt.in)
+        if num != tt.num || uom != tt.uom {
+            t.Errorf("splitPerfValue(%q) = (%q, %q), want (%q, %q)", tt.in, num, uom, tt.num, tt.uom)
+        }
+    }
+}
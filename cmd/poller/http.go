@@ -0,0 +1,378 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httptrace"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+func init() {
+    registerProber("http", httpProber{})
+}
+
+// httpParams are the check_params of an "http" target. Without a url the
+// target's host and port are used: port 443 means https, anything else http.
+type httpParams struct {
+    URL                string            `json:"url"`
+    Method             string            `json:"method"`
+    Headers            map[string]string `json:"headers"`
+    Body               string            `json:"body"`
+    ExpectStatus       []int             `json:"expect_status"`        // empty: any 2xx or 3xx
+    Contains           string            `json:"contains"`             // substring the body must contain
+    Match              string            `json:"match"`                // regex the body must match
+    FollowRedirects    bool              `json:"follow_redirects"`
+    MaxRedirects       int               `json:"max_redirects"`
+    TimeoutMs          int               `json:"timeout_ms"`           // whole request, body included
+    InsecureSkipVerify bool              `json:"insecure_skip_verify"` // still records the certificates
+    MaxBodyBytes       int64             `json:"max_body_bytes"`       // body read for contains/match
+}
+
+// httpTiming is the breakdown of the last request made by a probe (the
+// final one when redirects were followed). Trace callbacks run on the
+// transport's goroutines, hence the mutex.
+type httpTiming struct {
+    mu sync.Mutex
+
+    start, dnsStart, connStart, tlsStart time.Time
+    dns, connect, tls, firstByte         time.Duration
+    certs                                []*x509.Certificate // chain sent by the server
+}
+
+func (h *httpTiming) trace() *httptrace.ClientTrace {
+    lock := func(fn func()) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        fn()
+    }
+    return &httptrace.ClientTrace{
+        GetConn: func(string) {
+            lock(func() {
+                h.start = time.Now()
+                h.dns, h.connect, h.tls, h.firstByte = 0, 0, 0, 0
+                h.certs = nil
+            })
+        },
+        DNSStart: func(httptrace.DNSStartInfo) { lock(func() { h.dnsStart = time.Now() }) },
+        DNSDone:  func(httptrace.DNSDoneInfo) { lock(func() { h.dns = time.Since(h.dnsStart) }) },
+        ConnectStart: func(string, string) { lock(func() { h.connStart = time.Now() }) },
+        ConnectDone: func(_, _ string, err error) {
+            if err == nil {
+                lock(func() { h.connect = time.Since(h.connStart) })
+            }
+        },
+        TLSHandshakeStart: func() { lock(func() { h.tlsStart = time.Now() }) },
+        TLSHandshakeDone: func(tls.ConnectionState, error) {
+            lock(func() { h.tls = time.Since(h.tlsStart) })
+        },
+        GotFirstResponseByte: func() { lock(func() { h.firstByte = time.Since(h.start) }) },
+    }
+}
+
+// verifyConnection keeps the peer's chain, so certificates are recorded
+// even when verification fails (e.g. already expired), then verifies it
+// like crypto/tls would unless verification is disabled.
+func (h *httpTiming) verifyConnection(skipVerify bool) func(tls.ConnectionState) error {
+    return func(cs tls.ConnectionState) error {
+        h.mu.Lock()
+        h.certs = cs.PeerCertificates
+        h.mu.Unlock()
+
+        if skipVerify {
+            return nil
+        }
+        if len(cs.PeerCertificates) == 0 {
+            return errors.New("server sent no certificate")
+        }
+        opts := x509.VerifyOptions{DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+        for _, c := range cs.PeerCertificates[1:] {
+            opts.Intermediates.AddCert(c)
+        }
+        _, err := cs.PeerCertificates[0].Verify(opts)
+        return err
+    }
+}
+
+// httpProber checks a URL: the response status, optionally the body, and
+// for https the certificate chain. Latency is the total request time.
+type httpProber struct{}
+
+func (httpProber) Probe(ctx context.Context, t Target) PollResult {
+    params := httpParams{
+        Method:          "GET",
+        FollowRedirects: true,
+        MaxRedirects:    10,
+        TimeoutMs:       10000,
+        MaxBodyBytes:    1 << 20,
+    }
+    if err := decodeParams(t, &params); err != nil {
+        return downResult("%v", err)
+    }
+    if params.URL == "" {
+        params.URL = defaultHTTPURL(t)
+    }
+
+    var match *regexp.Regexp
+    if params.Match != "" {
+        re, err := regexp.Compile(params.Match)
+        if err != nil {
+            return downResult("invalid match pattern %q: %v", params.Match, err)
+        }
+        match = re
+    }
+
+    req, err := http.NewRequestWithContext(ctx, params.Method, params.URL, strings.NewReader(params.Body))
+    if err != nil {
+        return downResult("invalid HTTP request: %v", err)
+    }
+    for k, v := range params.Headers {
+        if strings.EqualFold(k, "Host") {
+            req.Host = v
+            continue
+        }
+        req.Header.Set(k, v)
+    }
+
+    timing := &httpTiming{}
+    req = req.WithContext(httptrace.WithClientTrace(req.Context(), timing.trace()))
+
+    redirects := 0
+    client := &http.Client{
+        Timeout: time.Duration(params.TimeoutMs) * time.Millisecond,
+        Transport: &http.Transport{
+            Proxy:             http.ProxyFromEnvironment,
+            DisableKeepAlives: true,
+            TLSClientConfig: &tls.Config{
+                // Verification is done in VerifyConnection so the chain is
+                // seen before a failed verification aborts the handshake.
+                InsecureSkipVerify: true,
+                VerifyConnection:   timing.verifyConnection(params.InsecureSkipVerify),
+            },
+        },
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if !params.FollowRedirects {
+                return http.ErrUseLastResponse
+            }
+            if len(via) > params.MaxRedirects {
+                return fmt.Errorf("stopped after %d redirects", params.MaxRedirects)
+            }
+            redirects = len(via)
+            return nil
+        },
+    }
+
+    start := time.Now()
+    resp, err := client.Do(req)
+    var body []byte
+    if err != nil {
+        // Only set alongside an error when CheckRedirect failed; the error
+        // says more than the redirect response
+        resp = nil
+    } else {
+        body, err = io.ReadAll(io.LimitReader(resp.Body, params.MaxBodyBytes))
+        resp.Body.Close()
+    }
+    total := time.Since(start)
+
+    timing.mu.Lock()
+    defer timing.mu.Unlock()
+
+    values := map[string]interface{}{
+        "url":      params.URL,
+        "dns_ms":   durationMs(timing.dns),
+        "total_ms": durationMs(total),
+    }
+    if timing.connect > 0 {
+        values["connect_ms"] = durationMs(timing.connect)
+    }
+    if timing.tls > 0 {
+        values["tls_ms"] = durationMs(timing.tls)
+    }
+    if timing.firstByte > 0 {
+        values["ttfb_ms"] = durationMs(timing.firstByte)
+    }
+    var certs tlsCertificates
+    if len(timing.certs) > 0 {
+        certs = tlsCertificates(timing.certs)
+        certs.addData(values)
+    }
+
+    result := checkHTTPResponse(params, resp, body, err, match)
+    result.Data = values
+    if certs != nil {
+        result.Extra = certs
+    }
+    if resp != nil {
+        values["status_code"] = resp.StatusCode
+        values["body_bytes"] = len(body)
+        if redirects > 0 {
+            values["redirects"] = redirects
+            values["final_url"] = resp.Request.URL.String()
+        }
+        if resp.TLS != nil {
+            values["tls_version"] = tls.VersionName(resp.TLS.Version)
+        }
+    }
+    if result.Status == "up" {
+        result.LatencyMs = int(total.Milliseconds())
+        result.Message = fmt.Sprintf("HTTP %s from %s in %.2f ms", resp.Status, params.URL, durationMs(total))
+    }
+    return result
+}
+
+// checkHTTPResponse decides the status of a probe from the response (or
+// the error that prevented one). Message and latency of an up result are
+// filled in by the caller.
+func checkHTTPResponse(params httpParams, resp *http.Response, body []byte, err error, match *regexp.Regexp) PollResult {
+    if resp == nil {
+        return downResult("HTTP %s %s failed: %v", params.Method, params.URL, err)
+    }
+    if !expectedStatus(params.ExpectStatus, resp.StatusCode) {
+        return downResult("HTTP %s from %s, expected %s", resp.Status, params.URL, describeExpected(params.ExpectStatus))
+    }
+    if err != nil {
+        return downResult("HTTP %s reading body: %v", params.URL, err)
+    }
+    if params.Contains != "" && !strings.Contains(string(body), params.Contains) {
+        return downResult("HTTP %s: body does not contain %q", params.URL, params.Contains)
+    }
+    if match != nil && !match.Match(body) {
+        return downResult("HTTP %s: body does not match %q", params.URL, params.Match)
+    }
+    return PollResult{Status: "up"}
+}
+
+func expectedStatus(expect []int, code int) bool {
+    if len(expect) == 0 {
+        return code >= 200 && code < 400
+    }
+    for _, c := range expect {
+        if c == code {
+            return true
+        }
+    }
+    return false
+}
+
+func describeExpected(expect []int) string {
+    if len(expect) == 0 {
+        return "2xx or 3xx"
+    }
+    codes := make([]string, len(expect))
+    for i, c := range expect {
+        codes[i] = strconv.Itoa(c)
+    }
+    return strings.Join(codes, ", ")
+}
+
+// defaultHTTPURL builds the URL checked when check_params has none.
+func defaultHTTPURL(t Target) string {
+    u := url.URL{Scheme: "http", Host: net.JoinHostPort(t.Host, strconv.Itoa(t.Port)), Path: "/"}
+    switch t.Port {
+    case 443:
+        u.Scheme = "https"
+        fallthrough
+    case 80:
+        u.Host = t.Host
+        if strings.Contains(t.Host, ":") {
+            u.Host = "[" + t.Host + "]"
+        }
+    }
+    return u.String()
+}
+
+// tlsCertificates is the chain a server presented, leaf first. It is
+// recorded into tls_certificates, where the alerter's cert_expiry rules
+// pick it up.
+type tlsCertificates []*x509.Certificate
+
+// addData puts the leaf's identity and the earliest expiry in the chain
+// into the poll result data.
+func (certs tlsCertificates) addData(values map[string]interface{}) {
+    leaf := certs[0]
+    values["cert_subject"] = leaf.Subject.String()
+    values["cert_issuer"] = leaf.Issuer.String()
+    values["cert_sans"] = certSANs(leaf)
+    values["cert_not_after"] = leaf.NotAfter.UTC().Format(time.RFC3339)
+
+    earliest := leaf.NotAfter
+    for _, c := range certs[1:] {
+        if c.NotAfter.Before(earliest) {
+            earliest = c.NotAfter
+        }
+    }
+    values["chain_not_after"] = earliest.UTC().Format(time.RFC3339)
+    values["cert_days_left"] = int(time.Until(earliest).Hours() / 24)
+}
+
+// Record upserts every certificate of the chain for the target. last_seen
+// is the same for the whole chain, so the certificates currently served are
+// the ones with the target's latest last_seen.
+func (certs tlsCertificates) Record(db *sql.DB, t Target, polledAt time.Time) {
+    if err := storeCertificates(db, t.ID, polledAt, certs); err != nil {
+        log.Printf("error storing TLS certificates for target %d (%s): %v", t.ID, t.Name, err)
+    }
+}
+
+// storeCertificates writes certs to tls_certificates. Times are passed as
+// timestamptz, so they are stored in the session time zone like NOW().
+func storeCertificates(db *sql.DB, targetID int, seenAt time.Time, certs tlsCertificates) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    stmt, err := tx.Prepare(`
+        INSERT INTO tls_certificates (target_id, fingerprint_sha256, chain_position, subject, issuer,
+                                      serial_number, sans, not_before, not_after, first_seen, last_seen)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8::timestamptz, $9::timestamptz, $10::timestamptz, $10::timestamptz)
+        ON CONFLICT (target_id, fingerprint_sha256) DO UPDATE
+        SET chain_position = EXCLUDED.chain_position,
+            last_seen = EXCLUDED.last_seen`)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+
+    for i, c := range certs {
+        sum := sha256.Sum256(c.Raw)
+        if _, err := stmt.Exec(targetID, hex.EncodeToString(sum[:]), i, c.Subject.String(),
+            c.Issuer.String(), c.SerialNumber.String(), pq.Array(certSANs(c)),
+            c.NotBefore, c.NotAfter, seenAt); err != nil {
+            return fmt.Errorf("certificate %d (%s): %v", i, c.Subject.CommonName, err)
+        }
+    }
+    return tx.Commit()
+}
+
+// certSANs lists the DNS names, IP addresses, emails and URIs of a
+// certificate's subjectAltName extension.
+func certSANs(c *x509.Certificate) []string {
+    sans := append([]string{}, c.DNSNames...)
+    for _, ip := range c.IPAddresses {
+        sans = append(sans, ip.String())
+    }
+    sans = append(sans, c.EmailAddresses...)
+    for _, u := range c.URIs {
+        sans = append(sans, u.String())
+    }
+    return sans
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "net"
+    "os"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/net/icmp"
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+// ICMPOptions controls how many echo requests are sent per poll and how
+// long to wait for them.
+type ICMPOptions struct {
+    Count    int           // echo requests per poll
+    Interval time.Duration // delay between requests
+    Timeout  time.Duration // wait for replies after the last request
+}
+
+// icmpOptions is set from the environment in main.
+var icmpOptions = ICMPOptions{Count: 5, Interval: 200 * time.Millisecond, Timeout: time.Second}
+
+// duration is how long a run takes when replies are missing.
+func (o ICMPOptions) duration() time.Duration {
+    return time.Duration(o.Count-1)*o.Interval + o.Timeout
+}
+
+// fit returns o cut down to run within d: fewer requests first, then a
+// shorter wait after the last one.
+func (o ICMPOptions) fit(d time.Duration) ICMPOptions {
+    for o.Count > 1 && o.duration() > d {
+        o.Count--
+    }
+    if o.duration() > d {
+        o.Timeout = max(d, 0)
+    }
+    return o
+}
+
+// PingStats summarises one run of echo requests against a host.
+type PingStats struct {
+    Sent     int
+    Received int
+    MinRtt   time.Duration
+    AvgRtt   time.Duration
+    MaxRtt   time.Duration
+    Jitter   time.Duration // mean absolute difference of consecutive RTTs
+}
+
+// LossPercent returns the percentage of requests that got no reply.
+func (s PingStats) LossPercent() float64 {
+    if s.Sent == 0 {
+        return 0
+    }
+    return float64(s.Sent-s.Received) * 100 / float64(s.Sent)
+}
+
+// pingID is the echo identifier of the next run; on raw sockets every
+// process sees every reply, so concurrent runs must not share an ID.
+var pingID = uint32(rand.Intn(1 << 16))
+
+func init() {
+    registerProber("icmp", icmpProber{})
+}
+
+// icmpProber checks reachability with ICMP echo requests.
+type icmpProber struct{}
+
+func (icmpProber) Probe(ctx context.Context, t Target) PollResult {
+    return pollTargetICMP(ctx, t)
+}
+
+// pollTargetICMP pings the target and maps the statistics onto a PollResult.
+// The target is up if at least one reply came back; latency is the average RTT.
+// Fewer requests are sent when icmpOptions would not finish before ctx's
+// deadline (the target's interval), leaving a tenth of it to spare.
+func pollTargetICMP(ctx context.Context, t Target) PollResult {
+    opts := icmpOptions
+    if deadline, ok := ctx.Deadline(); ok {
+        opts = opts.fit(time.Until(deadline) * 9 / 10)
+    }
+    stats, err := ping(ctx, t.Host, opts)
+    if err != nil {
+        return downResult("ICMP error: %v", err)
+    }
+
+    values := map[string]interface{}{
+        "icmp_sent":     stats.Sent,
+        "icmp_received": stats.Received,
+        "icmp_loss_pct": stats.LossPercent(),
+    }
+
+    if stats.Received == 0 {
+        r := downResult("ICMP no reply (%d sent)", stats.Sent)
+        r.Data = values
+        return r
+    }
+
+    values["rtt_min_ms"] = durationMs(stats.MinRtt)
+    values["rtt_avg_ms"] = durationMs(stats.AvgRtt)
+    values["rtt_max_ms"] = durationMs(stats.MaxRtt)
+    values["jitter_ms"] = durationMs(stats.Jitter)
+
+    return PollResult{
+        Status:    "up",
+        LatencyMs: int(stats.AvgRtt.Milliseconds()),
+        Message: fmt.Sprintf("ICMP %d/%d replies, %.0f%% loss, rtt min/avg/max = %.2f/%.2f/%.2f ms, jitter %.2f ms",
+            stats.Received, stats.Sent, stats.LossPercent(), durationMs(stats.MinRtt),
+            durationMs(stats.AvgRtt), durationMs(stats.MaxRtt), durationMs(stats.Jitter)),
+        Data: values,
+    }
+}
+
+func durationMs(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
+
+// ping sends opts.Count echo requests to host. It uses an unprivileged
+// datagram ICMP socket where the kernel allows it (Linux with
+// net.ipv4.ping_group_range covering our group, macOS) and falls back to a
+// raw socket, which needs root or CAP_NET_RAW. No more requests are sent
+// once ctx is done, and waiting for replies ends at ctx's deadline.
+func ping(ctx context.Context, host string, opts ICMPOptions) (PingStats, error) {
+    var stats PingStats
+
+    addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+    if err != nil {
+        return stats, err
+    }
+    // Prefer IPv4, as net.ResolveIPAddr does
+    dst := &addrs[0]
+    for i := range addrs {
+        if addrs[i].IP.To4() != nil {
+            dst = &addrs[i]
+            break
+        }
+    }
+
+    v4 := dst.IP.To4() != nil
+    dgramNet, rawNet, laddr, proto := "udp6", "ip6:ipv6-icmp", "::", 58
+    var echoType icmp.Type = ipv6.ICMPTypeEchoRequest
+    if v4 {
+        dgramNet, rawNet, laddr, proto = "udp4", "ip4:icmp", "0.0.0.0", 1
+        echoType = ipv4.ICMPTypeEcho
+    }
+
+    privileged := false
+    conn, err := icmp.ListenPacket(dgramNet, laddr)
+    if err != nil {
+        conn, err = icmp.ListenPacket(rawNet, laddr)
+        if err != nil {
+            return stats, fmt.Errorf("cannot open ICMP socket (needs ping_group_range or CAP_NET_RAW): %v", err)
+        }
+        privileged = true
+    }
+    defer conn.Close()
+
+    // Wake a pending read when ctx is cancelled
+    stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+    defer stop()
+
+    // Datagram sockets are addressed with a UDPAddr; the kernel replaces the
+    // echo ID with the socket's port and only delivers our own replies.
+    var to net.Addr = dst
+    if !privileged {
+        to = &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+    }
+
+    id := int(atomic.AddUint32(&pingID, 1) & 0xffff)
+    sentAt := make([]time.Time, opts.Count)
+    rtts := make([]time.Duration, opts.Count)
+    got := make([]bool, opts.Count)
+    buf := make([]byte, 1500)
+
+    // readUntil collects replies until the deadline (or ctx's, if earlier)
+    // or until every request sent so far has been answered.
+    readUntil := func(deadline time.Time) error {
+        if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+            deadline = d
+        }
+        for stats.Received < stats.Sent {
+            if err := conn.SetReadDeadline(deadline); err != nil {
+                return err
+            }
+            // Checked after setting the deadline, so a cancellation from
+            // here on is seen by the read through the AfterFunc above
+            if err := ctx.Err(); err != nil {
+                return err
+            }
+            n, peer, err := conn.ReadFrom(buf)
+            if err != nil {
+                if errors.Is(err, os.ErrDeadlineExceeded) {
+                    return ctx.Err()
+                }
+                return err
+            }
+            received := time.Now()
+
+            msg, err := icmp.ParseMessage(proto, buf[:n])
+            if err != nil {
+                continue
+            }
+            if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
+                continue
+            }
+            echo, ok := msg.Body.(*icmp.Echo)
+            if !ok || echo.Seq < 0 || echo.Seq >= stats.Sent || got[echo.Seq] {
+                continue
+            }
+            if privileged {
+                if echo.ID != id {
+                    continue
+                }
+                if ip, ok := peer.(*net.IPAddr); ok && !ip.IP.Equal(dst.IP) {
+                    continue
+                }
+            }
+
+            got[echo.Seq] = true
+            rtts[echo.Seq] = received.Sub(sentAt[echo.Seq])
+            stats.Received++
+        }
+        return nil
+    }
+
+    for seq := 0; seq < opts.Count; seq++ {
+        if err := ctx.Err(); err != nil {
+            return stats, err
+        }
+        msg := icmp.Message{
+            Type: echoType,
+            Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("auspex-ping")},
+        }
+        b, err := msg.Marshal(nil)
+        if err != nil {
+            return stats, err
+        }
+
+        sentAt[seq] = time.Now()
+        if _, err := conn.WriteTo(b, to); err != nil {
+            return stats, fmt.Errorf("send: %v", err)
+        }
+        stats.Sent++
+
+        wait := opts.Interval
+        if seq == opts.Count-1 {
+            wait = opts.Timeout
+        }
+        if err := readUntil(sentAt[seq].Add(wait)); err != nil {
+            if ctx.Err() != nil {
+                return stats, err
+            }
+            return stats, fmt.Errorf("receive: %v", err)
+        }
+        if seq < opts.Count-1 {
+            timer := time.NewTimer(time.Until(sentAt[seq].Add(opts.Interval)))
+            select {
+            case <-timer.C:
+            case <-ctx.Done():
+                timer.Stop()
+                return stats, ctx.Err()
+            }
+        }
+    }
+
+    var sum, diffSum time.Duration
+    var prev time.Duration
+    var havePrev bool
+    diffs := 0
+    for seq, ok := range got {
+        if !ok {
+            continue
+        }
+        rtt := rtts[seq]
+        if stats.MinRtt == 0 || rtt < stats.MinRtt {
+            stats.MinRtt = rtt
+        }
+        if rtt > stats.MaxRtt {
+            stats.MaxRtt = rtt
+        }
+        sum += rtt
+        if havePrev {
+            d := rtt - prev
+            if d < 0 {
+                d = -d
+            }
+            diffSum += d
+            diffs++
+        }
+        prev, havePrev = rtt, true
+    }
+    if stats.Received > 0 {
+        stats.AvgRtt = sum / time.Duration(stats.Received)
+    }
+    if diffs > 0 {
+        stats.Jitter = diffSum / time.Duration(diffs)
+    }
+
+    return stats, nil
+}
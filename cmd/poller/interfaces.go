@@ -0,0 +1,298 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+
+    gosnmp "github.com/gosnmp/gosnmp"
+)
+
+// IF-MIB columns walked for every target with collect_interfaces enabled.
+const (
+    oidIfDescr      = "1.3.6.1.2.1.2.2.1.2"
+    oidIfInOctets   = "1.3.6.1.2.1.2.2.1.10"
+    oidIfOperStatus = "1.3.6.1.2.1.2.2.1.8"
+    oidIfInErrors   = "1.3.6.1.2.1.2.2.1.14"
+    oidIfOutOctets  = "1.3.6.1.2.1.2.2.1.16"
+    oidIfOutDiscard = "1.3.6.1.2.1.2.2.1.19"
+    oidIfHCIn       = "1.3.6.1.2.1.31.1.1.1.6"
+    oidIfHCOut      = "1.3.6.1.2.1.31.1.1.1.10"
+    oidIfAlias      = "1.3.6.1.2.1.31.1.1.1.18"
+)
+
+// InterfaceSample is one interface's raw counters from a single poll.
+// Octet counters come from ifHCInOctets/ifHCOutOctets when the agent has
+// both of them for the interface (CounterBits = 64) and from the 32-bit
+// ifTable columns otherwise, so both directions always have the same width.
+type InterfaceSample struct {
+    Index       int
+    Descr       string
+    Alias       string
+    OperStatus  int
+    InOctets    uint64
+    OutOctets   uint64
+    CounterBits int
+    InErrors    uint64
+    OutDiscards uint64
+}
+
+// prevCounters is the last stored sample of an interface.
+type prevCounters struct {
+    SysUpTime   uint32
+    InOctets    uint64
+    OutOctets   uint64
+    CounterBits int
+    InErrors    uint64
+    OutDiscards uint64
+    SampledAt   time.Time
+}
+
+// collectInterfaces walks ifTable and ifXTable and returns one sample per
+// ifIndex. Missing ifXTable columns are not an error; SNMPv1 has no
+// Counter64, so the HC columns are not walked at all there.
+func collectInterfaces(g *gosnmp.GoSNMP) ([]InterfaceSample, error) {
+    byIndex := make(map[int]*InterfaceSample)
+    var order []int
+    hcIn := make(map[int]uint64)
+    hcOut := make(map[int]uint64)
+
+    sample := func(idx int) *InterfaceSample {
+        s, ok := byIndex[idx]
+        if !ok {
+            s = &InterfaceSample{Index: idx, CounterBits: 32}
+            byIndex[idx] = s
+            order = append(order, idx)
+        }
+        return s
+    }
+
+    walk := func(root string, fn func(s *InterfaceSample, v gosnmp.SnmpPDU)) error {
+        prefix := "." + root + "."
+        return snmpWalk(g, root, func(v gosnmp.SnmpPDU) error {
+            idx, err := strconv.Atoi(strings.TrimPrefix(v.Name, prefix))
+            if err != nil {
+                return nil
+            }
+            fn(sample(idx), v)
+            return nil
+        })
+    }
+
+    // ifDescr defines the set of interfaces; a failure here fails the walk
+    if err := walk(oidIfDescr, func(s *InterfaceSample, v gosnmp.SnmpPDU) {
+        s.Descr = snmpValueToString(v)
+    }); err != nil {
+        return nil, fmt.Errorf("ifDescr: %v", err)
+    }
+
+    type column struct {
+        oid string
+        fn  func(s *InterfaceSample, v gosnmp.SnmpPDU)
+    }
+    columns := []column{
+        {oidIfOperStatus, func(s *InterfaceSample, v gosnmp.SnmpPDU) { s.OperStatus = int(pduUint(v)) }},
+        {oidIfInOctets, func(s *InterfaceSample, v gosnmp.SnmpPDU) { s.InOctets = pduUint(v) }},
+        {oidIfOutOctets, func(s *InterfaceSample, v gosnmp.SnmpPDU) { s.OutOctets = pduUint(v) }},
+        {oidIfInErrors, func(s *InterfaceSample, v gosnmp.SnmpPDU) { s.InErrors = pduUint(v) }},
+        {oidIfOutDiscard, func(s *InterfaceSample, v gosnmp.SnmpPDU) { s.OutDiscards = pduUint(v) }},
+        {oidIfAlias, func(s *InterfaceSample, v gosnmp.SnmpPDU) { s.Alias = snmpValueToString(v) }},
+    }
+    if g.Version != gosnmp.Version1 {
+        columns = append(columns,
+            column{oidIfHCIn, func(s *InterfaceSample, v gosnmp.SnmpPDU) {
+                if v.Type == gosnmp.Counter64 {
+                    hcIn[s.Index] = pduUint(v)
+                }
+            }},
+            column{oidIfHCOut, func(s *InterfaceSample, v gosnmp.SnmpPDU) {
+                if v.Type == gosnmp.Counter64 {
+                    hcOut[s.Index] = pduUint(v)
+                }
+            }},
+        )
+    }
+
+    for _, c := range columns {
+        if err := walk(c.oid, c.fn); err != nil {
+            log.Printf("walk of %s on %s failed: %v", c.oid, g.Target, err)
+        }
+    }
+
+    result := make([]InterfaceSample, 0, len(order))
+    for _, idx := range order {
+        s := byIndex[idx]
+        in, inOK := hcIn[idx]
+        out, outOK := hcOut[idx]
+        if inOK && outOK {
+            s.InOctets, s.OutOctets, s.CounterBits = in, out, 64
+        }
+        result = append(result, *s)
+    }
+    return result, nil
+}
+
+// pduUint returns the unsigned value of a numeric PDU, or 0.
+func pduUint(v gosnmp.SnmpPDU) uint64 {
+    switch v.Type {
+    case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks,
+        gosnmp.Counter64, gosnmp.Uinteger32:
+        return gosnmp.ToBigInt(v.Value).Uint64()
+    }
+    return 0
+}
+
+// counterDelta returns how far a counter advanced between two samples.
+// A 32-bit counter that went backwards is assumed to have wrapped once.
+// 64-bit counters do not wrap in practice, so a decrease there means the
+// counter was reset and no delta can be computed.
+func counterDelta(prev, cur uint64, bits int) (uint64, bool) {
+    if cur >= prev {
+        return cur - prev, true
+    }
+    if bits == 32 && prev <= 1<<32-1 {
+        return cur + 1<<32 - prev, true
+    }
+    return 0, false
+}
+
+// sysUpTimeReset reports whether the agent restarted between two samples.
+// sysUpTime is a 32-bit TimeTicks value that wraps after ~497 days, so a
+// decrease only counts as a restart when it cannot be explained by a wrap
+// given the wall-clock time that passed. If the clock was stepped back
+// (negative elapsed) there is no telling, and no restart is reported.
+func sysUpTimeReset(prev, cur uint32, elapsed time.Duration) bool {
+    if cur >= prev || elapsed < 0 {
+        return false
+    }
+    expected := uint64(prev) + uint64(elapsed/(10*time.Millisecond))
+    if expected < 1<<32 {
+        return true
+    }
+    wrapped := expected - 1<<32
+    slack := uint64(elapsed/(10*time.Millisecond))/10 + 6000 // 10% + 60s
+    diff := wrapped - uint64(cur)
+    if uint64(cur) > wrapped {
+        diff = uint64(cur) - wrapped
+    }
+    return diff > slack
+}
+
+// storeInterfaceSamples computes per-second rates against the previous sample
+// of each interface, writes them to interface_stats and keeps the raw
+// counters in interface_counters so rates survive a poller restart.
+// Timestamps go through timestamptz both ways, like poll_results.polled_at:
+// the TIMESTAMP columns hold session time, and the elapsed time between
+// samples does not depend on the poller's time zone.
+func storeInterfaceSamples(db *sql.DB, targetID int, polledAt time.Time, sysUpTime uint32, samples []InterfaceSample) error {
+    if len(samples) == 0 {
+        return nil
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    prev, err := loadPrevCounters(tx, targetID)
+    if err != nil {
+        return err
+    }
+
+    statStmt, err := tx.Prepare(`
+        INSERT INTO interface_stats (target_id, if_index, if_descr, if_alias, oper_status,
+                                     in_bps, out_bps, in_errors_ps, out_discards_ps, polled_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::timestamptz)
+        ON CONFLICT DO NOTHING`)
+    if err != nil {
+        return err
+    }
+    defer statStmt.Close()
+
+    counterStmt, err := tx.Prepare(`
+        INSERT INTO interface_counters (target_id, if_index, sys_uptime, in_octets, out_octets,
+                                        counter_bits, in_errors, out_discards, sampled_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::timestamptz)
+        ON CONFLICT (target_id, if_index) DO UPDATE
+        SET sys_uptime = EXCLUDED.sys_uptime,
+            in_octets = EXCLUDED.in_octets,
+            out_octets = EXCLUDED.out_octets,
+            counter_bits = EXCLUDED.counter_bits,
+            in_errors = EXCLUDED.in_errors,
+            out_discards = EXCLUDED.out_discards,
+            sampled_at = EXCLUDED.sampled_at`)
+    if err != nil {
+        return err
+    }
+    defer counterStmt.Close()
+
+    for _, s := range samples {
+        var inBps, outBps, inErrPs, outDiscPs interface{}
+
+        if p, ok := prev[s.Index]; ok {
+            elapsed := polledAt.Sub(p.SampledAt)
+            if elapsed > 0 && !sysUpTimeReset(p.SysUpTime, sysUpTime, elapsed) {
+                secs := elapsed.Seconds()
+                rate := func(prev, cur uint64, bits int) interface{} {
+                    if d, ok := counterDelta(prev, cur, bits); ok {
+                        return float64(d) / secs
+                    }
+                    return nil
+                }
+                if p.CounterBits == s.CounterBits {
+                    if r := rate(p.InOctets, s.InOctets, s.CounterBits); r != nil {
+                        inBps = r.(float64) * 8
+                    }
+                    if r := rate(p.OutOctets, s.OutOctets, s.CounterBits); r != nil {
+                        outBps = r.(float64) * 8
+                    }
+                }
+                inErrPs = rate(p.InErrors, s.InErrors, 32)
+                outDiscPs = rate(p.OutDiscards, s.OutDiscards, 32)
+            }
+        }
+
+        if _, err := statStmt.Exec(targetID, s.Index, s.Descr, s.Alias, s.OperStatus,
+            inBps, outBps, inErrPs, outDiscPs, polledAt); err != nil {
+            return fmt.Errorf("interface %d stats: %v", s.Index, err)
+        }
+
+        if _, err := counterStmt.Exec(targetID, s.Index, int64(sysUpTime),
+            strconv.FormatUint(s.InOctets, 10), strconv.FormatUint(s.OutOctets, 10),
+            s.CounterBits, int64(s.InErrors), int64(s.OutDiscards), polledAt); err != nil {
+            return fmt.Errorf("interface %d counters: %v", s.Index, err)
+        }
+    }
+
+    return tx.Commit()
+}
+
+func loadPrevCounters(tx *sql.Tx, targetID int) (map[int]prevCounters, error) {
+    rows, err := tx.Query(`
+        SELECT if_index, sys_uptime, in_octets, out_octets, counter_bits,
+               in_errors, out_discards, sampled_at::timestamptz
+        FROM interface_counters
+        WHERE target_id = $1`, targetID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := make(map[int]prevCounters)
+    for rows.Next() {
+        var idx int
+        var upTime int64
+        var p prevCounters
+        if err := rows.Scan(&idx, &upTime, &p.InOctets, &p.OutOctets, &p.CounterBits,
+            &p.InErrors, &p.OutDiscards, &p.SampledAt); err != nil {
+            return nil, err
+        }
+        p.SysUpTime = uint32(upTime)
+        result[idx] = p
+    }
+    return result, rows.Err()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCounterDelta(t *testing.T) {
+    const max32 = 1<<32 - 1
+    tests := []struct {
+        name      string
+        prev, cur uint64
+        bits      int
+        want      uint64
+        ok        bool
+    }{
+        {"32-bit increase", 100, 250, 32, 150, true},
+        {"no change", 7, 7, 32, 0, true},
+        {"32-bit wrap", max32 - 9, 5, 32, 15, true},
+        {"32-bit wrap from max", max32, 0, 32, 1, true},
+        {"32-bit decrease from 64-bit value", 1 << 40, 5, 32, 0, false},
+        {"64-bit increase", 1 << 40, 1<<40 + 1000, 64, 1000, true},
+        {"64-bit decrease is a reset", 1 << 40, 10, 64, 0, false},
+        {"64-bit below 2^32 is not wrapped", 500, 10, 64, 0, false},
+    }
+    for _, tt := range tests {
+        got, ok := counterDelta(tt.prev, tt.cur, tt.bits)
+        if got != tt.want || ok != tt.ok {
+            t.Errorf("%s: counterDelta(%d, %d, %d) = (%d, %v), want (%d, %v)",
+                tt.name, tt.prev, tt.cur, tt.bits, got, ok, tt.want, tt.ok)
+        }
+    }
+}
+
+func TestSysUpTimeReset(t *testing.T) {
+    const ticks = 10 * time.Millisecond
+    const max32 = 1<<32 - 1
+    tests := []struct {
+        name      string
+        prev, cur uint32
+        elapsed   time.Duration
+        want      bool
+    }{
+        {"increase", 1000, 7000, time.Minute, false},
+        {"unchanged", 1000, 1000, time.Minute, false},
+        {"restart", 500000, 3000, time.Minute, true},
+        {"restart shortly after boot", 6000, 100, time.Minute, true},
+        {"wrap", max32 - 3000, 3000, time.Minute, false},
+        {"wrap with late poll", max32 - 3000, 26000, 5 * time.Minute, false},
+        {"too little uptime for a wrap", max32 - 3000, 1000, 5 * time.Minute, true},
+        {"restart after wrap window", max32 - 3000, 3000000, time.Minute, true},
+        {"restart near wrap", max32 - 100, max32 - 60000, 2 * time.Minute, true},
+        {"clock stepped back", 500000, 3000, -time.Hour, false},
+        {"clock stepped back at wrap", max32 - 3000, 3000, -time.Hour, false},
+        {"wrap a day late", max32 - 3000, uint32(24 * time.Hour / ticks), 24 * time.Hour, false},
+    }
+    for _, tt := range tests {
+        if got := sysUpTimeReset(tt.prev, tt.cur, tt.elapsed); got != tt.want {
+            t.Errorf("%s: sysUpTimeReset(%d, %d, %v) = %v, want %v",
+                tt.name, tt.prev, tt.cur, tt.elapsed, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Fingerprint maps a sysObjectID prefix (and optionally a sysDescr pattern)
+// to what kind of device it is.
+type Fingerprint struct {
+    OIDPrefix    string
+    DescrPattern string
+    Vendor       string
+    ModelFamily  string
+    OS           string
+
+    descrRe *regexp.Regexp
+}
+
+// Inventory is the identity of a device as reported by the system group.
+type Inventory struct {
+    SysObjectID string
+    SysName     string
+    SysDescr    string
+    SysContact  string
+    SysLocation string
+    Vendor      string
+    ModelFamily string
+    OS          string
+}
+
+// builtinFingerprints is the bundled fingerprint database. Rows in the
+// device_fingerprints table extend it and win over these on ties. Among
+// entries with the same prefix, earlier patterns are tried first (IOS XE
+// also says "Cisco IOS Software", so it must come before plain IOS).
+var builtinFingerprints = []Fingerprint{
+    {OIDPrefix: "1.3.6.1.4.1.9", Vendor: "Cisco"},
+    {OIDPrefix: "1.3.6.1.4.1.9", DescrPattern: `IOS[- ]XE`, Vendor: "Cisco", OS: "IOS XE"},
+    {OIDPrefix: "1.3.6.1.4.1.9", DescrPattern: `IOS XR`, Vendor: "Cisco", OS: "IOS XR"},
+    {OIDPrefix: "1.3.6.1.4.1.9", DescrPattern: `NX-OS`, Vendor: "Cisco", ModelFamily: "Nexus", OS: "NX-OS"},
+    {OIDPrefix: "1.3.6.1.4.1.9", DescrPattern: `Adaptive Security Appliance`, Vendor: "Cisco", ModelFamily: "ASA", OS: "ASA"},
+    {OIDPrefix: "1.3.6.1.4.1.9", DescrPattern: `Cisco IOS Software|IOS \(tm\)`, Vendor: "Cisco", OS: "IOS"},
+    {OIDPrefix: "1.3.6.1.4.1.2636", Vendor: "Juniper", OS: "Junos"},
+    {OIDPrefix: "1.3.6.1.4.1.2636", DescrPattern: `\bex\d`, Vendor: "Juniper", ModelFamily: "EX", OS: "Junos"},
+    {OIDPrefix: "1.3.6.1.4.1.2636", DescrPattern: `\bmx\d`, Vendor: "Juniper", ModelFamily: "MX", OS: "Junos"},
+    {OIDPrefix: "1.3.6.1.4.1.2636", DescrPattern: `\bsrx\d`, Vendor: "Juniper", ModelFamily: "SRX", OS: "Junos"},
+    {OIDPrefix: "1.3.6.1.4.1.30065", Vendor: "Arista", OS: "EOS"},
+    {OIDPrefix: "1.3.6.1.4.1.11", Vendor: "HP"},
+    {OIDPrefix: "1.3.6.1.4.1.11.2.3.7.11", Vendor: "HPE", ModelFamily: "ProCurve/Aruba switch", OS: "ArubaOS-Switch"},
+    {OIDPrefix: "1.3.6.1.4.1.11.2.3.9", Vendor: "HP", ModelFamily: "JetDirect printer"},
+    {OIDPrefix: "1.3.6.1.4.1.47196", Vendor: "HPE", ModelFamily: "Aruba CX switch", OS: "AOS-CX"},
+    {OIDPrefix: "1.3.6.1.4.1.14823", Vendor: "HPE", ModelFamily: "Aruba wireless", OS: "ArubaOS"},
+    {OIDPrefix: "1.3.6.1.4.1.14988", Vendor: "MikroTik", ModelFamily: "RouterBOARD", OS: "RouterOS"},
+    {OIDPrefix: "1.3.6.1.4.1.41112", Vendor: "Ubiquiti"},
+    {OIDPrefix: "1.3.6.1.4.1.12356", Vendor: "Fortinet", ModelFamily: "FortiGate", OS: "FortiOS"},
+    {OIDPrefix: "1.3.6.1.4.1.25461", Vendor: "Palo Alto Networks", OS: "PAN-OS"},
+    {OIDPrefix: "1.3.6.1.4.1.2620", Vendor: "Check Point", OS: "Gaia"},
+    {OIDPrefix: "1.3.6.1.4.1.3375", Vendor: "F5 Networks", ModelFamily: "BIG-IP", OS: "TMOS"},
+    {OIDPrefix: "1.3.6.1.4.1.2011", Vendor: "Huawei", OS: "VRP"},
+    {OIDPrefix: "1.3.6.1.4.1.1991", Vendor: "Ruckus", ModelFamily: "ICX switch", OS: "FastIron"},
+    {OIDPrefix: "1.3.6.1.4.1.25053", Vendor: "Ruckus", ModelFamily: "Wireless"},
+    {OIDPrefix: "1.3.6.1.4.1.6486", Vendor: "Alcatel-Lucent Enterprise", ModelFamily: "OmniSwitch", OS: "AOS"},
+    {OIDPrefix: "1.3.6.1.4.1.674", Vendor: "Dell"},
+    {OIDPrefix: "1.3.6.1.4.1.6027", Vendor: "Dell", ModelFamily: "Force10", OS: "FTOS"},
+    {OIDPrefix: "1.3.6.1.4.1.8072.3.2.10", Vendor: "Net-SNMP", OS: "Linux"},
+    {OIDPrefix: "1.3.6.1.4.1.8072.3.2.8", Vendor: "Net-SNMP", OS: "FreeBSD"},
+    {OIDPrefix: "1.3.6.1.4.1.8072.3.2.8", DescrPattern: `pfSense`, Vendor: "Netgate", ModelFamily: "pfSense", OS: "FreeBSD"},
+    {OIDPrefix: "1.3.6.1.4.1.8072.3.2.8", DescrPattern: `OPNsense`, Vendor: "Deciso", ModelFamily: "OPNsense", OS: "FreeBSD"},
+    {OIDPrefix: "1.3.6.1.4.1.311.1.1.3.1.1", Vendor: "Microsoft", ModelFamily: "Workstation", OS: "Windows"},
+    {OIDPrefix: "1.3.6.1.4.1.311.1.1.3.1.2", Vendor: "Microsoft", ModelFamily: "Server", OS: "Windows Server"},
+    {OIDPrefix: "1.3.6.1.4.1.311.1.1.3.1.3", Vendor: "Microsoft", ModelFamily: "Domain Controller", OS: "Windows Server"},
+    {OIDPrefix: "1.3.6.1.4.1.6876", Vendor: "VMware", ModelFamily: "ESXi", OS: "ESXi"},
+    {OIDPrefix: "1.3.6.1.4.1.318", Vendor: "APC", ModelFamily: "UPS/PDU"},
+    {OIDPrefix: "1.3.6.1.4.1.534", Vendor: "Eaton", ModelFamily: "UPS"},
+    {OIDPrefix: "1.3.6.1.4.1.6574", Vendor: "Synology", ModelFamily: "NAS", OS: "DSM"},
+    {OIDPrefix: "1.3.6.1.4.1.24681", Vendor: "QNAP", ModelFamily: "NAS", OS: "QTS"},
+    {OIDPrefix: "1.3.6.1.4.1.2435", Vendor: "Brother", ModelFamily: "Printer"},
+    {OIDPrefix: "1.3.6.1.4.1.1602", Vendor: "Canon", ModelFamily: "Printer"},
+    {OIDPrefix: "1.3.6.1.4.1.367", Vendor: "Ricoh", ModelFamily: "Printer"},
+}
+
+// FingerprintDB matches sysObjectID/sysDescr pairs against fingerprints,
+// most specific first.
+type FingerprintDB []Fingerprint
+
+// loadFingerprints merges the device_fingerprints table over the builtin list.
+func loadFingerprints(db *sql.DB) (FingerprintDB, error) {
+    rows, err := db.Query(`
+        SELECT oid_prefix, COALESCE(descr_pattern, ''), vendor,
+               COALESCE(model_family, ''), COALESCE(os, '')
+        FROM device_fingerprints`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var custom []Fingerprint
+    for rows.Next() {
+        var f Fingerprint
+        if err := rows.Scan(&f.OIDPrefix, &f.DescrPattern, &f.Vendor, &f.ModelFamily, &f.OS); err != nil {
+            return nil, err
+        }
+        custom = append(custom, f)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return newFingerprintDB(append(custom, builtinFingerprints...)), nil
+}
+
+// newFingerprintDB compiles patterns and orders entries so that longer
+// prefixes, and entries with a sysDescr pattern, are tried first. The sort
+// is stable so earlier entries win ties.
+func newFingerprintDB(list []Fingerprint) FingerprintDB {
+    fdb := make(FingerprintDB, 0, len(list))
+    for _, f := range list {
+        f.OIDPrefix = strings.TrimPrefix(f.OIDPrefix, ".")
+        if f.DescrPattern != "" {
+            re, err := regexp.Compile("(?i)" + f.DescrPattern)
+            if err != nil {
+                log.Printf("warning: ignoring fingerprint %s with bad pattern %q: %v",
+                    f.OIDPrefix, f.DescrPattern, err)
+                continue
+            }
+            f.descrRe = re
+        }
+        fdb = append(fdb, f)
+    }
+
+    sort.SliceStable(fdb, func(i, j int) bool {
+        if len(fdb[i].OIDPrefix) != len(fdb[j].OIDPrefix) {
+            return len(fdb[i].OIDPrefix) > len(fdb[j].OIDPrefix)
+        }
+        return fdb[i].descrRe != nil && fdb[j].descrRe == nil
+    })
+    return fdb
+}
+
+// Identify fills in Vendor, ModelFamily and OS from the best matching
+// fingerprint. Unknown enterprises are reported as "enterprise N".
+func (fdb FingerprintDB) Identify(inv *Inventory) {
+    oid := strings.TrimPrefix(inv.SysObjectID, ".")
+    if oid == "" {
+        return
+    }
+
+    for _, f := range fdb {
+        if oid != f.OIDPrefix && !strings.HasPrefix(oid, f.OIDPrefix+".") {
+            continue
+        }
+        if f.descrRe != nil && !f.descrRe.MatchString(inv.SysDescr) {
+            continue
+        }
+        inv.Vendor, inv.ModelFamily, inv.OS = f.Vendor, f.ModelFamily, f.OS
+        return
+    }
+
+    const enterprises = "1.3.6.1.4.1."
+    if strings.HasPrefix(oid, enterprises) {
+        inv.Vendor = "enterprise " + strings.SplitN(strings.TrimPrefix(oid, enterprises), ".", 2)[0]
+    }
+}
+
+// upsertInventory stores the device identity in device_inventory and
+// writes a device_inventory_history row for every attribute that changed.
+func upsertInventory(db *sql.DB, targetID int, seenAt time.Time, inv Inventory) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var prev Inventory
+    err = tx.QueryRow(`
+        SELECT sys_object_id, sys_name, sys_descr, sys_contact, sys_location,
+               vendor, model_family, os
+        FROM device_inventory
+        WHERE target_id = $1
+        FOR UPDATE`, targetID).Scan(&prev.SysObjectID, &prev.SysName, &prev.SysDescr,
+        &prev.SysContact, &prev.SysLocation, &prev.Vendor, &prev.ModelFamily, &prev.OS)
+    if err != nil && err != sql.ErrNoRows {
+        return err
+    }
+
+    if err == nil {
+        changes := []struct{ attr, before, after string }{
+            {"sys_object_id", prev.SysObjectID, inv.SysObjectID},
+            {"sys_name", prev.SysName, inv.SysName},
+            {"sys_descr", prev.SysDescr, inv.SysDescr},
+            {"sys_contact", prev.SysContact, inv.SysContact},
+            {"sys_location", prev.SysLocation, inv.SysLocation},
+            {"vendor", prev.Vendor, inv.Vendor},
+            {"model_family", prev.ModelFamily, inv.ModelFamily},
+            {"os", prev.OS, inv.OS},
+        }
+        for _, c := range changes {
+            if c.before == c.after {
+                continue
+            }
+            if _, err := tx.Exec(`
+                INSERT INTO device_inventory_history (target_id, attribute, old_value, new_value, changed_at)
+                VALUES ($1, $2, $3, $4, $5::timestamptz)`,
+                targetID, c.attr, c.before, c.after, seenAt); err != nil {
+                return err
+            }
+        }
+    }
+
+    if _, err := tx.Exec(`
+        INSERT INTO device_inventory (target_id, sys_object_id, sys_name, sys_descr, sys_contact,
+                                      sys_location, vendor, model_family, os, first_seen, last_seen)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::timestamptz, $10::timestamptz)
+        ON CONFLICT (target_id) DO UPDATE
+        SET sys_object_id = EXCLUDED.sys_object_id,
+            sys_name = EXCLUDED.sys_name,
+            sys_descr = EXCLUDED.sys_descr,
+            sys_contact = EXCLUDED.sys_contact,
+            sys_location = EXCLUDED.sys_location,
+            vendor = EXCLUDED.vendor,
+            model_family = EXCLUDED.model_family,
+            os = EXCLUDED.os,
+            last_seen = EXCLUDED.last_seen`,
+        targetID, inv.SysObjectID, inv.SysName, inv.SysDescr, inv.SysContact,
+        inv.SysLocation, inv.Vendor, inv.ModelFamily, inv.OS, seenAt); err != nil {
+        return err
+    }
+
+    return tx.Commit()
+}
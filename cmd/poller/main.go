@@ -1,17 +1,26 @@
 package main
 
 import (
+    "context"
     "database/sql"
+    "encoding/json"
+    "errors"
     "fmt"
     "log"
-    "math/rand"
+    "net"
     "os"
+    "os/signal"
+    "path/filepath"
     "strconv"
-    "sync"
+    "strings"
+    "sync/atomic"
+    "syscall"
     "time"
 
     gosnmp "github.com/gosnmp/gosnmp"
-    _ "github.com/lib/pq"
+    "github.com/lib/pq"
+
+    "auspex/internal/snmpv3"
 )
 
 type Target struct {
@@ -21,11 +30,148 @@ type Target struct {
     Port        int
     Community   string
     SNMPVersion string
+    CheckType   string          // key into the prober registry: "snmp", "icmp", "both", ...
+    CheckParams json.RawMessage // check-specific settings (targets.check_params)
+
+    // How often to poll the target; 0 uses AUSPEX_POLL_INTERVAL_SECONDS
+    PollInterval time.Duration
+
+    // SNMPv3 (USM) settings, only used when SNMPVersion is "3"
+    SecurityName   string
+    SecurityLevel  string
+    AuthProtocol   string
+    AuthPassphrase string
+    PrivProtocol   string
+    PrivPassphrase string
+    ContextName    string
+
+    // Walk ifTable/ifXTable and compute interface rates
+    CollectInterfaces bool
+
+    // Walk LLDP/CDP neighbor tables into topology_links
+    CollectTopology bool
+
+    // SNMP client overrides, from the target or its templates
+    SNMP SNMPSettings
+
+    // OIDs from the OID groups (templates) assigned to this target
+    OIDs []OIDDefinition
 }
 
-func main() {
-    rand.Seed(time.Now().UnixNano())
+// SNMPSettings overrides the SNMP client defaults for a target. A field set
+// on the target wins; otherwise it is inherited from the target's OID groups
+// (templates), and when none sets it the built-in default is used.
+type SNMPSettings struct {
+    TimeoutMs          sql.NullInt64  // per attempt
+    Retries            sql.NullInt64
+    ExponentialTimeout sql.NullBool   // double the timeout on every retry
+    Transport          sql.NullString // "udp" or "tcp"
+    MaxOids            sql.NullInt64  // varbinds per GET request
+    MaxRepetitions     sql.NullInt64  // GetBulk max-repetitions when walking
+    SourceAddress      sql.NullString // local IP to send from on multi-homed pollers
+}
+
+// snmpSettingsColumns selects SNMPSettings from targets or oid_groups, in
+// the order of SNMPSettings.dest.
+const snmpSettingsColumns = `snmp_timeout_ms, snmp_retries, snmp_exponential_backoff, snmp_transport,
+               snmp_max_oids, snmp_max_repetitions, host(snmp_source_address)`
+
+// dest returns the scan destinations for snmpSettingsColumns.
+func (s *SNMPSettings) dest() []interface{} {
+    return []interface{}{&s.TimeoutMs, &s.Retries, &s.ExponentialTimeout, &s.Transport,
+        &s.MaxOids, &s.MaxRepetitions, &s.SourceAddress}
+}
+
+// inherit fills the fields s leaves unset from o.
+func (s *SNMPSettings) inherit(o SNMPSettings) {
+    if !s.TimeoutMs.Valid {
+        s.TimeoutMs = o.TimeoutMs
+    }
+    if !s.Retries.Valid {
+        s.Retries = o.Retries
+    }
+    if !s.ExponentialTimeout.Valid {
+        s.ExponentialTimeout = o.ExponentialTimeout
+    }
+    if !s.Transport.Valid {
+        s.Transport = o.Transport
+    }
+    if !s.MaxOids.Valid {
+        s.MaxOids = o.MaxOids
+    }
+    if !s.MaxRepetitions.Valid {
+        s.MaxRepetitions = o.MaxRepetitions
+    }
+    if !s.SourceAddress.Valid {
+        s.SourceAddress = o.SourceAddress
+    }
+}
+
+// apply sets the fields s overrides on g.
+func (s SNMPSettings) apply(g *gosnmp.GoSNMP) error {
+    if s.TimeoutMs.Valid {
+        g.Timeout = time.Duration(s.TimeoutMs.Int64) * time.Millisecond
+    }
+    if s.Retries.Valid {
+        g.Retries = int(s.Retries.Int64)
+    }
+    if s.ExponentialTimeout.Valid {
+        g.ExponentialTimeout = s.ExponentialTimeout.Bool
+    }
+    if s.Transport.Valid {
+        switch s.Transport.String {
+        case "udp", "tcp":
+            g.Transport = s.Transport.String
+        default:
+            return fmt.Errorf("unsupported snmp_transport %q", s.Transport.String)
+        }
+    }
+    if s.MaxOids.Valid {
+        g.MaxOids = int(s.MaxOids.Int64)
+    }
+    if s.MaxRepetitions.Valid {
+        g.MaxRepetitions = uint32(s.MaxRepetitions.Int64)
+    }
+    if s.SourceAddress.Valid {
+        g.LocalAddr = net.JoinHostPort(s.SourceAddress.String, "0")
+    }
+    return nil
+}
+
+// PollResult is the outcome of probing one target, whatever the check type,
+// and maps onto one poll_results row. Status is "up", "degraded", "down" or
+// "unknown". Message is the human-readable summary shown in the UI, Error is
+// the failure reason and only set when the check did not come back up, and
+// Data holds the typed measurements (stored as JSONB). Extra is optional
+// prober-specific data that is recorded after the row is written.
+type PollResult struct {
+    Status    string
+    LatencyMs int
+    Message   string
+    Error     string
+    Data      map[string]interface{}
+    Extra     Recorder
+}
+
+// downResult builds a failed PollResult whose message and error are the
+// formatted description of the failure.
+func downResult(format string, args ...interface{}) PollResult {
+    msg := fmt.Sprintf(format, args...)
+    return PollResult{Status: "down", Message: msg, Error: msg}
+}
+
+// SNMPData is everything collected from an "up" target beyond the system
+// group values that go into the poll_results message.
+type SNMPData struct {
+    SysUpTime    uint32
+    HasSysUpTime bool
+    Inventory    Inventory
+    Metrics      []Metric
+    Interfaces   []InterfaceSample
+    Topology     *Topology // nil when not collected or the walk failed
+}
 
+func main() {
     dbHost := getenv("AUSPEX_DB_HOST", "localhost")
     dbPort := getenv("AUSPEX_DB_PORT", "5432")
     dbName := getenv("AUSPEX_DB_NAME", "auspexdb")
@@ -33,6 +179,11 @@ func main() {
     dbPass := getenv("AUSPEX_DB_PASSWORD", "")
     intervalStr := getenv("AUSPEX_POLL_INTERVAL_SECONDS", "60")
     maxConcStr := getenv("AUSPEX_MAX_CONCURRENT_POLLS", "10")
+    batchStr := getenv("AUSPEX_WRITE_BATCH_SIZE", "500")
+    flushStr := getenv("AUSPEX_WRITE_FLUSH_MS", "1000")
+    shutdownStr := getenv("AUSPEX_SHUTDOWN_TIMEOUT_SECONDS", "30")
+    heartbeatStr := getenv("AUSPEX_POLLER_HEARTBEAT_SECONDS", "10")
+    leaseStr := getenv("AUSPEX_POLLER_LEASE_SECONDS", "30")
 
     intervalSec, err := strconv.Atoi(intervalStr)
     if err != nil || intervalSec <= 0 {
@@ -44,6 +195,54 @@ func main() {
         maxConcurrent = 10
     }
 
+    batchSize, err := strconv.Atoi(batchStr)
+    if err != nil || batchSize <= 0 {
+        batchSize = 500
+    }
+
+    flushMs, err := strconv.Atoi(flushStr)
+    if err != nil || flushMs <= 0 {
+        flushMs = 1000
+    }
+
+    shutdownSec, err := strconv.Atoi(shutdownStr)
+    if err != nil || shutdownSec <= 0 {
+        shutdownSec = 30
+    }
+
+    heartbeatSec, err := strconv.Atoi(heartbeatStr)
+    if err != nil || heartbeatSec <= 0 {
+        heartbeatSec = 10
+    }
+
+    leaseSec, err := strconv.Atoi(leaseStr)
+    if err != nil || leaseSec <= heartbeatSec {
+        leaseSec = 3 * heartbeatSec
+    }
+
+    if host, err := os.Hostname(); err == nil {
+        pollerID = host
+    }
+    pollerID = getenv("AUSPEX_POLLER_ID", pollerID)
+
+    if n, err := strconv.Atoi(getenv("AUSPEX_ICMP_COUNT", "5")); err == nil && n > 0 {
+        icmpOptions.Count = n
+    }
+    if ms, err := strconv.Atoi(getenv("AUSPEX_ICMP_INTERVAL_MS", "200")); err == nil && ms >= 0 {
+        icmpOptions.Interval = time.Duration(ms) * time.Millisecond
+    }
+    if ms, err := strconv.Atoi(getenv("AUSPEX_ICMP_TIMEOUT_MS", "1000")); err == nil && ms > 0 {
+        icmpOptions.Timeout = time.Duration(ms) * time.Millisecond
+    }
+    if d := icmpOptions.duration(); d > time.Duration(intervalSec)*time.Second*9/10 {
+        log.Printf("warning: ICMP polls take up to %v, too long for the %ds poll interval; fewer echo requests will be sent",
+            d, intervalSec)
+    }
+
+    if dirs := getenv("AUSPEX_PLUGIN_DIRS", ""); dirs != "" {
+        pluginDirs = filepath.SplitList(dirs)
+    }
+
     connStr := fmt.Sprintf(
         "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
         dbHost, dbPort, dbUser, dbPass, dbName,
@@ -59,62 +258,113 @@ func main() {
         log.Fatalf("failed to ping DB: %v", err)
     }
 
-    log.Printf("Auspex SNMP poller started (interval=%ds, maxConcurrent=%d)", intervalSec, maxConcurrent)
-
-    ticker := time.NewTicker(time.Duration(intervalSec) * time.Second)
-    defer ticker.Stop()
+    if len(os.Args) > 1 && os.Args[1] == "discover" {
+        if err := runDiscover(db, os.Args[2:]); err != nil {
+            log.Fatalf("discover: %v", err)
+        }
+        return
+    }
 
-    pollOnce(db, maxConcurrent) // initial poll
+    log.Printf("Auspex SNMP poller %s started (interval=%ds, maxConcurrent=%d)", pollerID, intervalSec, maxConcurrent)
 
-    for range ticker.C {
-        pollOnce(db, maxConcurrent)
-    }
-}
+    stopping, ctx := shutdownContext(time.Duration(shutdownSec) * time.Second)
 
-func pollOnce(db *sql.DB, maxConcurrent int) {
-    targets, err := loadTargets(db)
-    if err != nil {
-        log.Printf("error loading targets: %v", err)
-        return
+    // Triggers on targets notify auspex_targets, so the scheduler only
+    // reloads the targets that changed and polls new ones right away
+    listener := pq.NewListener(connStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+        if err != nil {
+            log.Printf("error in target listener: %v", err)
+        }
+    })
+    defer listener.Close()
+    var notify <-chan *pq.Notification
+    if err := listener.Listen("auspex_targets"); err != nil {
+        log.Printf("error listening for target changes, reloading all targets every %ds: %v", intervalSec, err)
+    } else {
+        notify = listener.Notify
     }
 
-    if len(targets) == 0 {
-        log.Printf("no enabled targets to poll")
-        return
+    // Take the lease before polling, so a poller joining others does not
+    // poll every target until its first heartbeat
+    shard := newShard(db, time.Duration(heartbeatSec)*time.Second, time.Duration(leaseSec)*time.Second)
+    if err := shard.renew(); err != nil {
+        log.Printf("error taking poller lease, polling all targets until it succeeds: %v", err)
     }
+    go shard.run(stopping)
 
-    log.Printf("polling %d targets", len(targets))
+    writer := newResultWriter(db, batchSize, time.Duration(flushMs)*time.Millisecond)
+    s := newScheduler(db, writer, shard, notify, time.Duration(intervalSec)*time.Second, maxConcurrent)
+    s.run(ctx, stopping)
 
-    sem := make(chan struct{}, maxConcurrent)
-    var wg sync.WaitGroup
+    s.wait()
+    writer.close()
+    shard.release()
+    log.Printf("poller stopped")
+}
 
-    for _, t := range targets {
-        wg.Add(1)
-        sem <- struct{}{}
+// shutdownContext handles SIGTERM and SIGINT. stopping is done as soon as a
+// signal arrives, after which no new poll is started; ctx is cancelled
+// drain later (or on a second signal) to abort the polls still in flight.
+func shutdownContext(drain time.Duration) (stopping, ctx context.Context) {
+    sigs := make(chan os.Signal, 2)
+    signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+    stopping, stop := context.WithCancel(context.Background())
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        sig := <-sigs
+        log.Printf("received %v, waiting up to %v for polls in flight", sig, drain)
+        stop()
+
+        select {
+        case <-time.After(drain):
+            log.Printf("shutdown timeout exceeded, aborting polls in flight")
+        case <-sigs:
+            log.Printf("received second signal, aborting polls in flight")
+        }
+        cancel()
+    }()
+    return stopping, ctx
+}
 
-        go func(t Target) {
-            defer wg.Done()
-            defer func() { <-sem }()
+// pollTarget probes one target, giving up after timeout, and queues the
+// result for writing. It reports whether the target failed (down or
+// unknown). A poll aborted by shutdown is dropped rather than recorded as a
+// failure.
+func pollTarget(ctx context.Context, db *sql.DB, w *resultWriter, t Target, timeout time.Duration) (failed bool) {
+    pollCtx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    polledAt := time.Now()
+    result := probeTarget(pollCtx, t)
+    if ctx.Err() != nil {
+        log.Printf("poll of target %d (%s) aborted by shutdown", t.ID, t.Name)
+        return false
+    }
+    if pollCtx.Err() != nil && result.Status != "up" {
+        result = downResult("poll did not finish within %v", timeout)
+    }
 
-            status, latency, message := pollTargetSNMP(t)
+    w.queue(t, result)
 
-            if err := insertResult(db, t.ID, status, latency, message); err != nil {
-                log.Printf("error inserting poll result for target %d (%s): %v", t.ID, t.Name, err)
-            } else {
-                log.Printf("polled target %d (%s) host=%s status=%s latency=%dms msg=%q",
-                    t.ID, t.Name, t.Host, status, latency, message)
-            }
-        }(t)
+    if result.Extra != nil {
+        result.Extra.Record(db, t, polledAt)
     }
-
-    wg.Wait()
+    return result.Status == "down" || result.Status == "unknown"
 }
 
-func loadTargets(db *sql.DB) ([]Target, error) {
+// loadTargets returns the enabled targets, or only those of them with the
+// given IDs.
+func loadTargets(db *sql.DB, ids ...int) ([]Target, error) {
     rows, err := db.Query(`
-        SELECT id, name, host, port, community, snmp_version
+        SELECT id, name, host, port, community, snmp_version, check_type, check_params,
+               COALESCE(snmp_security_name, ''), COALESCE(snmp_security_level, ''),
+               COALESCE(snmp_auth_protocol, ''), COALESCE(snmp_auth_passphrase, ''),
+               COALESCE(snmp_priv_protocol, ''), COALESCE(snmp_priv_passphrase, ''),
+               COALESCE(snmp_context_name, ''), collect_interfaces, collect_topology,
+               COALESCE(poll_interval_seconds, 0), ` + snmpSettingsColumns + `
         FROM targets
-        WHERE enabled = true`)
+        WHERE enabled = true AND ($1::int[] IS NULL OR id = ANY($1))`, pq.Array(ids))
     if err != nil {
         return nil, err
     }
@@ -123,96 +373,392 @@ func loadTargets(db *sql.DB) ([]Target, error) {
     var result []Target
     for rows.Next() {
         var t Target
-        if err := rows.Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.Community, &t.SNMPVersion); err != nil {
+        var intervalSec int
+        dest := []interface{}{&t.ID, &t.Name, &t.Host, &t.Port, &t.Community, &t.SNMPVersion, &t.CheckType, &t.CheckParams,
+            &t.SecurityName, &t.SecurityLevel, &t.AuthProtocol, &t.AuthPassphrase,
+            &t.PrivProtocol, &t.PrivPassphrase, &t.ContextName, &t.CollectInterfaces,
+            &t.CollectTopology, &intervalSec}
+        if err := rows.Scan(append(dest, t.SNMP.dest()...)...); err != nil {
             return nil, err
         }
+        t.PollInterval = time.Duration(intervalSec) * time.Second
         result = append(result, t)
     }
-    return result, rows.Err()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    defs, err := loadOIDDefinitions(db, ids)
+    if err != nil {
+        return nil, fmt.Errorf("loading OID templates: %v", err)
+    }
+    settings, err := loadTemplateSNMPSettings(db, ids)
+    if err != nil {
+        return nil, fmt.Errorf("loading template SNMP settings: %v", err)
+    }
+    for i := range result {
+        result[i].OIDs = defs[result[i].ID]
+        result[i].SNMP.inherit(settings[result[i].ID])
+    }
+    return result, nil
+}
+
+func init() {
+    registerProber("snmp", snmpChecker)
+    registerProber("both", anyProber{{"SNMP", snmpChecker}, {"ICMP", icmpProber{}}})
+}
+
+// snmpChecker is shared by the "snmp" and "both" check types so the
+// fingerprint database is only loaded once per cycle.
+var snmpChecker = &snmpProber{}
+
+// snmpProber polls targets over SNMP and identifies the device against the
+// fingerprint database. Everything beyond the system group is returned as
+// *SNMPData in PollResult.Extra. The fingerprint database is swapped
+// atomically, as polls of the previous cycle may still be running while it
+// is reloaded.
+type snmpProber struct {
+    fingerprints atomic.Pointer[FingerprintDB]
+}
+
+func (p *snmpProber) Prepare(db *sql.DB) {
+    fingerprints, err := loadFingerprints(db)
+    if err != nil {
+        log.Printf("error loading device fingerprints, using builtin list: %v", err)
+        fingerprints = newFingerprintDB(builtinFingerprints)
+    }
+    p.fingerprints.Store(&fingerprints)
+}
+
+func (p *snmpProber) Probe(ctx context.Context, t Target) PollResult {
+    result, data := pollTargetSNMP(ctx, t)
+    if data != nil {
+        if fingerprints := p.fingerprints.Load(); fingerprints != nil {
+            fingerprints.Identify(&data.Inventory)
+        }
+        result.Data["vendor"] = data.Inventory.Vendor
+        result.Data["model_family"] = data.Inventory.ModelFamily
+        result.Data["os"] = data.Inventory.OS
+        result.Extra = data
+    }
+    return result
+}
+
+// Record writes inventory, uptime, template metrics, interface rates and
+// topology collected by an SNMP poll. Failures are logged per table so one
+// broken table does not lose the rest.
+func (data *SNMPData) Record(db *sql.DB, t Target, polledAt time.Time) {
+    if err := upsertInventory(db, t.ID, polledAt, data.Inventory); err != nil {
+        log.Printf("error updating inventory for target %d (%s): %v", t.ID, t.Name, err)
+    }
+    if data.HasSysUpTime {
+        rebooted, err := recordSysUpTime(db, t.ID, polledAt, data.SysUpTime)
+        if err != nil {
+            log.Printf("error recording sysUpTime for target %d (%s): %v", t.ID, t.Name, err)
+        } else if rebooted {
+            log.Printf("target %d (%s) rebooted (sysUpTime=%d)", t.ID, t.Name, data.SysUpTime)
+        }
+    }
+    if err := insertMetrics(db, t.ID, polledAt, data.Metrics); err != nil {
+        log.Printf("error inserting metrics for target %d (%s): %v", t.ID, t.Name, err)
+    }
+    if err := storeInterfaceSamples(db, t.ID, polledAt, data.SysUpTime, data.Interfaces); err != nil {
+        log.Printf("error storing interface samples for target %d (%s): %v", t.ID, t.Name, err)
+    }
+    if data.Topology != nil {
+        if err := storeTopology(db, t.ID, polledAt, *data.Topology); err != nil {
+            log.Printf("error storing topology for target %d (%s): %v", t.ID, t.Name, err)
+        }
+    }
 }
 
-// pollTargetSNMP performs a real SNMP v2c poll against three OIDs:
+// pollTargetSNMP performs a real SNMP poll (v1, v2c or v3) against the
+// system group:
 //  - sysDescr (1.3.6.1.2.1.1.1.0)
+//  - sysObjectID (1.3.6.1.2.1.1.2.0)
 //  - sysUpTime (1.3.6.1.2.1.1.3.0)
+//  - sysContact (1.3.6.1.2.1.1.4.0)
 //  - sysName  (1.3.6.1.2.1.1.5.0)
+//  - sysLocation (1.3.6.1.2.1.1.6.0)
 //
 // SUCCESS criteria:
 //  - SNMP connection succeeds
-//  - GET on all three OIDs returns values
+//  - GET returns a value for at least one of sysDescr, sysUpTime, sysName
 //  - status = "up", latency = RTT in ms
+//  - result data carries the system group values (sys_uptime as TimeTicks)
 // FAILURE (timeout / error / missing OID):
 //  - status = "down"
 //  - latency = 0
-//  - message includes error description
-func pollTargetSNMP(t Target) (status string, latencyMs int, message string) {
-    version := gosnmp.Version2c
-    // schema allows other values, but we default to v2c for now
-    if t.SNMPVersion != "" && t.SNMPVersion != "2c" {
-        log.Printf("warning: target %d (%s) has unsupported snmp_version=%q, forcing v2c",
-            t.ID, t.Name, t.SNMPVersion)
-    }
-
-    g := &gosnmp.GoSNMP{
-        Target:    t.Host,
-        Port:      uint16(t.Port),
-        Community: t.Community,
-        Version:   version,
-        Timeout:   2 * time.Second,
-        Retries:   1,
-        Transport: "udp",
-        MaxOids:   3,
+//  - message and error include the error description
+//
+// When the target is up, the OIDs of its assigned templates and (if enabled)
+// the interface table are collected over the same session and returned as data.
+func pollTargetSNMP(ctx context.Context, t Target) (PollResult, *SNMPData) {
+    g, version, err := newSNMPClient(t)
+    if err != nil {
+        return downResult("SNMP configuration error: %v", err), nil
     }
+    g.Context = ctx
 
     start := time.Now()
     if err := g.Connect(); err != nil {
-        return "down", 0, fmt.Sprintf("SNMP connect failed: %v", err)
+        return downResult("SNMP connect failed: %v", err), nil
     }
     defer g.Conn.Close()
 
     oids := []string{
         "1.3.6.1.2.1.1.1.0", // sysDescr
+        "1.3.6.1.2.1.1.2.0", // sysObjectID
         "1.3.6.1.2.1.1.3.0", // sysUpTime
+        "1.3.6.1.2.1.1.4.0", // sysContact
         "1.3.6.1.2.1.1.5.0", // sysName
+        "1.3.6.1.2.1.1.6.0", // sysLocation
     }
 
-    pkt, err := g.Get(oids)
-    latencyMs = int(time.Since(start).Milliseconds())
+    vars, err := snmpGet(g, oids)
+    latencyMs := int(time.Since(start).Milliseconds())
 
     if err != nil {
-        return "down", 0, fmt.Sprintf("SNMP GET failed: %v", err)
-    }
-
-    if pkt == nil || pkt.Error != gosnmp.NoError {
-        return "down", 0, fmt.Sprintf("SNMP error: %v", pkt.Error)
+        if isAuthFailure(err) {
+            return downResult("SNMPv3 authentication failed: %v", err), nil
+        }
+        return downResult("SNMP GET failed: %v", err), nil
     }
 
-    if len(pkt.Variables) != len(oids) {
-        return "down", 0, fmt.Sprintf("SNMP response missing variables (got=%d expected=%d)",
-            len(pkt.Variables), len(oids))
-    }
+    data := &SNMPData{}
 
     var descr, uptime, name string
-    for i, v := range pkt.Variables {
+    for i, v := range vars {
         switch oids[i] {
         case "1.3.6.1.2.1.1.1.0": // sysDescr
             descr = snmpValueToString(v)
+        case "1.3.6.1.2.1.1.2.0": // sysObjectID
+            data.Inventory.SysObjectID = strings.TrimPrefix(snmpValueToString(v), ".")
         case "1.3.6.1.2.1.1.3.0": // sysUpTime
             uptime = snmpValueToString(v)
+            if v.Type == gosnmp.TimeTicks {
+                data.SysUpTime = uint32(pduUint(v))
+                data.HasSysUpTime = true
+            }
+        case "1.3.6.1.2.1.1.4.0": // sysContact
+            data.Inventory.SysContact = snmpValueToString(v)
         case "1.3.6.1.2.1.1.5.0": // sysName
             name = snmpValueToString(v)
+        case "1.3.6.1.2.1.1.6.0": // sysLocation
+            data.Inventory.SysLocation = snmpValueToString(v)
         }
     }
+    data.Inventory.SysName = name
+    data.Inventory.SysDescr = descr
 
     if descr == "" && uptime == "" && name == "" {
-        return "down", 0, "SNMP GET returned no usable values"
+        return downResult("SNMP GET returned no usable values"), nil
+    }
+
+    data.Metrics = collectMetrics(g, t)
+    if t.CollectInterfaces {
+        data.Interfaces, err = collectInterfaces(g)
+        if err != nil {
+            log.Printf("target %d (%s): interface walk failed: %v", t.ID, t.Name, err)
+        }
+    }
+    if t.CollectTopology {
+        ifNames := make(map[int]string, len(data.Interfaces))
+        for _, s := range data.Interfaces {
+            ifNames[s.Index] = s.Descr
+        }
+        topo, err := collectTopology(g, ifNames)
+        if err != nil {
+            log.Printf("target %d (%s): neighbor walk failed: %v", t.ID, t.Name, err)
+        } else {
+            data.Topology = &topo
+        }
+    }
+
+    values := map[string]interface{}{
+        "snmp_version":  version,
+        "sys_name":      name,
+        "sys_descr":     descr,
+        "sys_object_id": data.Inventory.SysObjectID,
+        "sys_contact":   data.Inventory.SysContact,
+        "sys_location":  data.Inventory.SysLocation,
+    }
+    if data.HasSysUpTime {
+        values["sys_uptime"] = data.SysUpTime
+    }
+    if data.Topology != nil {
+        values["neighbors"] = len(data.Topology.Neighbors)
     }
 
-    msg := fmt.Sprintf("sysName=%q sysDescr=%q sysUpTime=%q", name, descr, uptime)
-    return "up", latencyMs, msg
+    return PollResult{
+        Status:    "up",
+        LatencyMs: latencyMs,
+        Message:   fmt.Sprintf("sysName=%q sysDescr=%q sysUpTime=%q", name, descr, uptime),
+        Data:      values,
+    }, data
+}
+
+// newSNMPClient builds an unconnected session for the target's SNMP version
+// and credentials. It also returns the version label actually used.
+func newSNMPClient(t Target) (*gosnmp.GoSNMP, string, error) {
+    g := &gosnmp.GoSNMP{
+        Target:    t.Host,
+        Port:      uint16(t.Port),
+        Community: t.Community,
+        Version:   gosnmp.Version2c,
+        Timeout:   2 * time.Second,
+        Retries:   1,
+        Transport: "udp",
+        MaxOids:   3,
+    }
+
+    if err := t.SNMP.apply(g); err != nil {
+        return nil, "", err
+    }
+
+    version := "2c"
+    switch t.SNMPVersion {
+    case "1":
+        g.Version = gosnmp.Version1
+        version = "1"
+    case "", "2c":
+        // default
+    case "3":
+        if err := applyUSM(g, t); err != nil {
+            return nil, "", err
+        }
+        version = "3"
+    default:
+        log.Printf("warning: target %d (%s) has unsupported snmp_version=%q, forcing v2c",
+            t.ID, t.Name, t.SNMPVersion)
+    }
+
+    return g, version, nil
+}
+
+// snmpGet fetches oids and returns one PDU per requested OID, in order.
+// Requests are chunked to g.MaxOids. OIDs the agent does not implement come
+// back as NoSuchObject instead of failing the whole poll: SNMPv1 agents
+// answer a single unknown OID with a noSuchName error for the entire PDU, so
+// the offending varbind is dropped and the rest re-requested. Requests the
+// agent rejects as tooBig are split in half and retried.
+func snmpGet(g *gosnmp.GoSNMP, oids []string) ([]gosnmp.SnmpPDU, error) {
+    result := make([]gosnmp.SnmpPDU, len(oids))
+
+    chunk := g.MaxOids
+    if chunk <= 0 {
+        chunk = gosnmp.MaxOids
+    }
+
+    for start := 0; start < len(oids); start += chunk {
+        end := start + chunk
+        if end > len(oids) {
+            end = len(oids)
+        }
+        idx := make([]int, 0, end-start)
+        for i := start; i < end; i++ {
+            idx = append(idx, i)
+        }
+        if err := snmpGetInto(g, oids, idx, result); err != nil {
+            return nil, err
+        }
+    }
+    return result, nil
+}
+
+// snmpGetInto fetches oids[i] for every i in idx and stores the PDUs at
+// result[i].
+func snmpGetInto(g *gosnmp.GoSNMP, oids []string, idx []int, result []gosnmp.SnmpPDU) error {
+    for len(idx) > 0 {
+        req := make([]string, len(idx))
+        for i, j := range idx {
+            req[i] = oids[j]
+        }
+
+        pkt, err := g.Get(req)
+        if err != nil {
+            return err
+        }
+        if pkt == nil {
+            return fmt.Errorf("empty response")
+        }
+
+        switch pkt.Error {
+        case gosnmp.NoError:
+            if len(pkt.Variables) != len(req) {
+                return fmt.Errorf("response missing variables (got=%d expected=%d)",
+                    len(pkt.Variables), len(req))
+            }
+            for i, v := range pkt.Variables {
+                result[idx[i]] = v
+            }
+            return nil
+
+        case gosnmp.NoSuchName:
+            // error-index is 1-based and points at the unknown varbind
+            bad := int(pkt.ErrorIndex) - 1
+            if bad < 0 || bad >= len(idx) {
+                return fmt.Errorf("agent returned %v with invalid error-index %d", pkt.Error, pkt.ErrorIndex)
+            }
+            result[idx[bad]] = gosnmp.SnmpPDU{Name: oids[idx[bad]], Type: gosnmp.NoSuchObject}
+            idx = append(idx[:bad:bad], idx[bad+1:]...)
+
+        case gosnmp.TooBig:
+            if len(idx) == 1 {
+                return fmt.Errorf("agent returned %v for a single OID %s", pkt.Error, req[0])
+            }
+            half := len(idx) / 2
+            if err := snmpGetInto(g, oids, idx[:half], result); err != nil {
+                return err
+            }
+            idx = idx[half:]
+
+        default:
+            return fmt.Errorf("agent returned %v", pkt.Error)
+        }
+    }
+    return nil
+}
+
+// applyUSM switches g to SNMPv3 and fills in the User-based Security Model
+// parameters from the target's credentials.
+func applyUSM(g *gosnmp.GoSNMP, t Target) error {
+    flags, usm, err := snmpv3.Credentials{
+        SecurityName:   t.SecurityName,
+        SecurityLevel:  t.SecurityLevel,
+        AuthProtocol:   t.AuthProtocol,
+        AuthPassphrase: t.AuthPassphrase,
+        PrivProtocol:   t.PrivProtocol,
+        PrivPassphrase: t.PrivPassphrase,
+    }.USM()
+    if err != nil {
+        return err
+    }
+
+    g.Version = gosnmp.Version3
+    g.SecurityModel = gosnmp.UserSecurityModel
+    g.MsgFlags = flags
+    g.SecurityParameters = usm
+    g.ContextName = t.ContextName
+    return nil
+}
+
+// isAuthFailure reports whether err is a USM report indicating bad
+// credentials rather than an unreachable device.
+func isAuthFailure(err error) bool {
+    return errors.Is(err, gosnmp.ErrWrongDigest) ||
+        errors.Is(err, gosnmp.ErrUnknownUsername) ||
+        errors.Is(err, gosnmp.ErrUnknownSecurityLevel) ||
+        errors.Is(err, gosnmp.ErrDecryption)
 }
 
 // Convert SNMP variable to string safely
 func snmpValueToString(v gosnmp.SnmpPDU) string {
+    switch v.Type {
+    case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+        return ""
+    }
+
     switch val := v.Value.(type) {
     case string:
         return val
@@ -225,15 +771,6 @@ func snmpValueToString(v gosnmp.SnmpPDU) string {
     }
 }
 
-func insertResult(db *sql.DB, targetID int, status string, latency int, message string) error {
-    _, err := db.Exec(
-        `INSERT INTO poll_results (target_id, status, latency_ms, message, polled_at)
-         VALUES ($1, $2, $3, $4, NOW())`,
-        targetID, status, latency, message,
-    )
-    return err
-}
-
 func getenv(key, fallback string) string {
     v := os.Getenv(key)
     if v == "" {
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+func init() {
+    registerProber("ntp", ntpProber{})
+}
+
+// ntpParams are the check_params of an "ntp" target. A threshold of 0 is
+// not checked; exceeding a _warn threshold marks the target degraded, a
+// _crit threshold down.
+type ntpParams struct {
+    Port         int `json:"port"`
+    TimeoutMs    int `json:"timeout_ms"`
+    OffsetWarnMs int `json:"offset_warn_ms"` // absolute clock offset against the poller
+    OffsetCritMs int `json:"offset_crit_ms"`
+    StratumWarn  int `json:"stratum_warn"`
+    StratumCrit  int `json:"stratum_crit"`
+}
+
+// ntpEpochOffset is the number of seconds from the NTP epoch (1900) to the
+// Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// NTPResponse is what one SNTP exchange (RFC 4330) tells about a server.
+type NTPResponse struct {
+    Leap           int // 0 no warning, 1/2 leap second pending, 3 unsynchronised
+    Version        int
+    Stratum        int
+    RefID          string
+    RootDelay      time.Duration
+    RootDispersion time.Duration
+    Offset         time.Duration // server clock minus poller clock
+    Delay          time.Duration // round trip, without the server's processing time
+}
+
+// ntpProber sends one SNTP client request to the target. Latency is the
+// round-trip delay. The offset is measured against the poller's clock, so
+// the poller host must itself be synchronised.
+type ntpProber struct{}
+
+func (ntpProber) Probe(ctx context.Context, t Target) PollResult {
+    params := ntpParams{Port: 123, TimeoutMs: 2000, OffsetWarnMs: 100, OffsetCritMs: 1000}
+    if err := decodeParams(t, &params); err != nil {
+        return downResult("%v", err)
+    }
+
+    server := net.JoinHostPort(t.Host, strconv.Itoa(params.Port))
+    resp, err := queryNTP(ctx, server, time.Duration(params.TimeoutMs)*time.Millisecond)
+    if err != nil {
+        return downResult("NTP %s: %v", server, err)
+    }
+
+    values := map[string]interface{}{
+        "stratum":            resp.Stratum,
+        "refid":              resp.RefID,
+        "leap":               resp.Leap,
+        "version":            resp.Version,
+        "offset_ms":          durationMs(resp.Offset),
+        "delay_ms":           durationMs(resp.Delay),
+        "root_delay_ms":      durationMs(resp.RootDelay),
+        "root_dispersion_ms": durationMs(resp.RootDispersion),
+    }
+    summary := fmt.Sprintf("stratum %d, refid %s, offset %+.3f ms, delay %.3f ms",
+        resp.Stratum, resp.RefID, durationMs(resp.Offset), durationMs(resp.Delay))
+
+    result := PollResult{
+        Status:    "up",
+        LatencyMs: int(resp.Delay.Milliseconds()),
+        Message:   "NTP " + summary,
+        Data:      values,
+    }
+
+    var down, degraded []string
+    if resp.Leap == 3 || resp.Stratum >= 16 {
+        down = append(down, "server is not synchronised")
+    }
+    offsetMs := math.Abs(durationMs(resp.Offset))
+    switch {
+    case params.OffsetCritMs > 0 && offsetMs > float64(params.OffsetCritMs):
+        down = append(down, fmt.Sprintf("offset above %d ms", params.OffsetCritMs))
+    case params.OffsetWarnMs > 0 && offsetMs > float64(params.OffsetWarnMs):
+        degraded = append(degraded, fmt.Sprintf("offset above %d ms", params.OffsetWarnMs))
+    }
+    switch {
+    case params.StratumCrit > 0 && resp.Stratum > params.StratumCrit:
+        down = append(down, fmt.Sprintf("stratum above %d", params.StratumCrit))
+    case params.StratumWarn > 0 && resp.Stratum > params.StratumWarn:
+        degraded = append(degraded, fmt.Sprintf("stratum above %d", params.StratumWarn))
+    }
+
+    if len(down) > 0 {
+        result.Status = "down"
+    } else if len(degraded) > 0 {
+        result.Status = "degraded"
+    }
+    if result.Status != "up" {
+        result.Error = fmt.Sprintf("NTP %s: %s", server, strings.Join(append(down, degraded...), ", "))
+        result.Message = result.Error + " (" + summary + ")"
+    }
+    return result
+}
+
+// queryNTP performs one SNTP exchange with server.
+func queryNTP(ctx context.Context, server string, timeout time.Duration) (NTPResponse, error) {
+    var resp NTPResponse
+
+    conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "udp", server)
+    if err != nil {
+        return resp, err
+    }
+    defer conn.Close()
+    if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+        return resp, err
+    }
+
+    // LI 0, version 4, mode 3 (client); the transmit timestamp comes back
+    // as the origin timestamp and identifies the reply.
+    req := make([]byte, 48)
+    req[0] = 0<<6 | 4<<3 | 3
+    sent := time.Now()
+    binary.BigEndian.PutUint64(req[40:], toNTPTime(sent))
+    if _, err := conn.Write(req); err != nil {
+        return resp, err
+    }
+
+    buf := make([]byte, 512)
+    for {
+        n, err := conn.Read(buf)
+        if err != nil {
+            if errors.Is(err, os.ErrDeadlineExceeded) {
+                return resp, fmt.Errorf("no reply within %v", timeout)
+            }
+            return resp, err
+        }
+        received := time.Now()
+        if n < 48 || binary.BigEndian.Uint64(buf[24:]) != binary.BigEndian.Uint64(req[40:]) {
+            continue // not the answer to this request
+        }
+
+        if mode := buf[0] & 0x07; mode != 4 {
+            return resp, fmt.Errorf("unexpected reply mode %d", mode)
+        }
+        resp.Leap = int(buf[0] >> 6)
+        resp.Version = int(buf[0] >> 3 & 0x07)
+        resp.Stratum = int(buf[1])
+        resp.RefID = ntpRefID(resp.Stratum, buf[12:16])
+        if resp.Stratum == 0 {
+            // Kiss-o'-Death: the refid holds the reason, e.g. RATE or DENY
+            return resp, fmt.Errorf("kiss-o'-death %s", resp.RefID)
+        }
+        resp.RootDelay = ntpShortDuration(binary.BigEndian.Uint32(buf[4:]))
+        resp.RootDispersion = ntpShortDuration(binary.BigEndian.Uint32(buf[8:]))
+
+        serverReceive := fromNTPTime(binary.BigEndian.Uint64(buf[32:]))
+        serverTransmit := fromNTPTime(binary.BigEndian.Uint64(buf[40:]))
+        resp.Offset = (serverReceive.Sub(sent) + serverTransmit.Sub(received)) / 2
+        resp.Delay = received.Sub(sent) - serverTransmit.Sub(serverReceive)
+        if resp.Delay < 0 {
+            resp.Delay = 0
+        }
+        return resp, nil
+    }
+}
+
+// ntpRefID renders the reference ID: a four letter source code such as
+// GPS or PPS for stratum 0/1, otherwise the upstream server's IPv4 address
+// (or for IPv6 upstreams the first four bytes of an MD5 hash).
+func ntpRefID(stratum int, b []byte) string {
+    if stratum <= 1 {
+        return strings.TrimRight(string(b), "\x00")
+    }
+    return net.IP(b).String()
+}
+
+func toNTPTime(t time.Time) uint64 {
+    secs := uint64(t.Unix() + ntpEpochOffset)
+    frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+    return secs<<32 | frac
+}
+
+// fromNTPTime converts a 32.32 timestamp. With the top bit clear it is taken
+// to be in era 1 (from February 2036), as RFC 4330 section 3 suggests.
+func fromNTPTime(v uint64) time.Time {
+    secs := int64(v >> 32)
+    if secs&0x80000000 == 0 {
+        secs += 1 << 32
+    }
+    secs -= ntpEpochOffset
+    nanos := int64((v & 0xffffffff) * uint64(time.Second) >> 32)
+    return time.Unix(secs, nanos)
+}
+
+// ntpShortDuration converts an NTP short format value (16.16 seconds).
+func ntpShortDuration(v uint32) time.Duration {
+    return time.Duration(uint64(v) * uint64(time.Second) >> 16)
+}
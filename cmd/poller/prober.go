@@ -0,0 +1,138 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Prober runs one kind of check against a target. A single Prober serves
+// every target of its check type and is called from many poll goroutines at
+// once, so Probe must be safe for concurrent use.
+//
+// The returned PollResult is written to poll_results as-is; anything a
+// prober collects beyond that goes into PollResult.Extra.
+type Prober interface {
+    Probe(ctx context.Context, t Target) PollResult
+}
+
+// Preparer is implemented by probers that load shared state (for example
+// the SNMP fingerprint database) at the start of each poll cycle. Polls
+// dispatched in the previous cycle may still be running, so Prepare must
+// replace the state in a way that is safe for concurrent Probe calls.
+type Preparer interface {
+    Prepare(db *sql.DB)
+}
+
+// Recorder is implemented by prober-specific result data that is written to
+// its own tables once the poll_results row has been queued.
+type Recorder interface {
+    Record(db *sql.DB, t Target, polledAt time.Time)
+}
+
+// probers maps targets.check_type to the Prober that handles it.
+var probers = make(map[string]Prober)
+
+// registerProber makes a check type available to the poller. It is called
+// from init functions; registering the same check type twice is a bug.
+func registerProber(checkType string, p Prober) {
+    if _, dup := probers[checkType]; dup {
+        log.Fatalf("prober for check type %q registered twice", checkType)
+    }
+    probers[checkType] = p
+}
+
+// checkTypes returns the registered check types, sorted.
+func checkTypes() []string {
+    types := make([]string, 0, len(probers))
+    for ct := range probers {
+        types = append(types, ct)
+    }
+    sort.Strings(types)
+    return types
+}
+
+// prepareProbers runs Prepare on every registered prober that needs it.
+func prepareProbers(db *sql.DB) {
+    for _, ct := range checkTypes() {
+        if p, ok := probers[ct].(Preparer); ok {
+            p.Prepare(db)
+        }
+    }
+}
+
+// probeTarget runs the prober registered for the target's check type.
+// Probers give up early when ctx is cancelled.
+func probeTarget(ctx context.Context, t Target) PollResult {
+    p, ok := probers[t.CheckType]
+    if !ok {
+        return downResult("unknown check type %q (known: %s)", t.CheckType, strings.Join(checkTypes(), ", "))
+    }
+    return p.Probe(ctx, t)
+}
+
+// decodeParams unmarshals the target's check_params into v, which should
+// already hold the defaults. Unknown keys are rejected so typos show up as a
+// failed check instead of a silently ignored setting.
+func decodeParams(t Target, v interface{}) error {
+    if len(t.CheckParams) == 0 {
+        return nil
+    }
+    dec := json.NewDecoder(bytes.NewReader(t.CheckParams))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        return fmt.Errorf("invalid check_params for %s check: %v", t.CheckType, err)
+    }
+    return nil
+}
+
+// namedProber labels one member of an anyProber in messages and data keys.
+type namedProber struct {
+    name string // e.g. "SNMP"; data keys use the lower-case form
+    p    Prober
+}
+
+// anyProber runs several probers against the same target and reports it up
+// if any of them succeeds, so status_change alerts act as a redundant
+// reachability check. The message and data still show which members failed
+// (as "<name>_error"). Latency comes from the last member that succeeded,
+// so list the most representative one last.
+type anyProber []namedProber
+
+func (a anyProber) Probe(ctx context.Context, t Target) PollResult {
+    result := PollResult{Status: "down", Data: make(map[string]interface{})}
+    var parts, failures []string
+
+    for _, m := range a {
+        r := m.p.Probe(ctx, t)
+        for k, v := range r.Data {
+            result.Data[k] = v
+        }
+        if r.Extra != nil && result.Extra == nil {
+            result.Extra = r.Extra
+        }
+
+        if r.Status == "up" {
+            result.Status = "up"
+            result.LatencyMs = r.LatencyMs
+            parts = append(parts, r.Message)
+            continue
+        }
+        failure := m.name + ": " + r.Error
+        result.Data[strings.ToLower(m.name)+"_error"] = r.Error
+        parts = append(parts, failure)
+        failures = append(failures, failure)
+    }
+
+    result.Message = strings.Join(parts, "; ")
+    if result.Status != "up" {
+        result.Error = strings.Join(failures, "; ")
+    }
+    return result
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "database/sql"
+    "time"
+)
+
+// recordSysUpTime compares the target's sysUpTime with the value stored from
+// the previous poll and records a reboot_events row when it went backwards
+// (other than a 497-day TimeTicks wrap). It returns true if a reboot was
+// detected. Times are passed and read as timestamptz, so the elapsed time
+// between polls does not depend on the poller's time zone.
+func recordSysUpTime(db *sql.DB, targetID int, polledAt time.Time, upTime uint32) (bool, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    var prevUpTime int64
+    var prevAt time.Time
+    err = tx.QueryRow(`
+        SELECT sys_uptime, sampled_at::timestamptz
+        FROM target_uptime
+        WHERE target_id = $1
+        FOR UPDATE`, targetID).Scan(&prevUpTime, &prevAt)
+    if err != nil && err != sql.ErrNoRows {
+        return false, err
+    }
+
+    rebooted := err == nil && sysUpTimeReset(uint32(prevUpTime), upTime, polledAt.Sub(prevAt))
+    if rebooted {
+        bootTime := polledAt.Add(-time.Duration(upTime) * 10 * time.Millisecond)
+        if _, err := tx.Exec(`
+            INSERT INTO reboot_events (target_id, boot_time, previous_uptime, current_uptime, detected_at)
+            VALUES ($1, $2::timestamptz, $3, $4, NOW())`,
+            targetID, bootTime, prevUpTime, int64(upTime)); err != nil {
+            return false, err
+        }
+    }
+
+    if _, err := tx.Exec(`
+        INSERT INTO target_uptime (target_id, sys_uptime, sampled_at)
+        VALUES ($1, $2, $3::timestamptz)
+        ON CONFLICT (target_id) DO UPDATE
+        SET sys_uptime = EXCLUDED.sys_uptime,
+            sampled_at = EXCLUDED.sampled_at`,
+        targetID, int64(upTime), polledAt); err != nil {
+        return false, err
+    }
+
+    return rebooted, tx.Commit()
+}
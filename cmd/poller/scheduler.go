@@ -0,0 +1,364 @@
+package main
+
+import (
+    "container/heap"
+    "context"
+    "database/sql"
+    "log"
+    "math/bits"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// scheduler polls every target on its own interval. Targets wait in a
+// min-heap ordered by the time their next poll is due; the run loop sleeps
+// until the earliest one and starts it, so a 15s core router and a 10 minute
+// printer share one poller without polling each other's targets.
+//
+// Each target is polled at a fixed offset into its interval (see
+// pollOffset), so targets with the same interval are spread evenly over it
+// instead of all starting at once. A poll may take at most the target's
+// interval; a target whose previous poll is still running when it is due
+// again is skipped rather than polled twice.
+//
+// Target changes arrive as auspex_targets notifications (see the
+// notify_target_change trigger) and are applied one target at a time; added
+// and re-enabled targets are polled right away. Without a listener, every
+// target is reloaded each interval instead.
+//
+// All enabled targets are queued, but only those the shard assigns to this
+// poller are polled, so a change in live pollers takes effect at once.
+type scheduler struct {
+    db       *sql.DB
+    writer   *resultWriter
+    shard    *shard
+    notify   <-chan *pq.Notification // nil when not listening for target changes
+    interval time.Duration           // for targets without poll_interval_seconds, and the cycle length
+
+    queue   scheduleQueue
+    entries map[int]*scheduleEntry // by target ID
+
+    sem     chan struct{}  // limits concurrent polls
+    pending sync.WaitGroup // polls and cycle records in flight
+
+    mu       sync.Mutex
+    inFlight map[int]bool // target IDs being polled
+}
+
+// scheduleEntry is one target in the queue.
+type scheduleEntry struct {
+    target Target
+    next   time.Time // when the next poll is due
+    index  int       // position in the heap, maintained by scheduleQueue
+}
+
+func newScheduler(db *sql.DB, writer *resultWriter, shard *shard, notify <-chan *pq.Notification, interval time.Duration, maxConcurrent int) *scheduler {
+    return &scheduler{
+        db:       db,
+        writer:   writer,
+        shard:    shard,
+        notify:   notify,
+        interval: interval,
+        entries:  make(map[int]*scheduleEntry),
+        sem:      make(chan struct{}, maxConcurrent),
+        inFlight: make(map[int]bool),
+    }
+}
+
+// targetInterval is how often t is polled.
+func (s *scheduler) targetInterval(t Target) time.Duration {
+    if t.PollInterval > 0 {
+        return t.PollInterval
+    }
+    return s.interval
+}
+
+// run polls each target when it is due, with ctx, until stopping is done.
+// A new poll cycle starts every interval. Polls still in flight when it
+// returns are waited for with wait.
+func (s *scheduler) run(ctx, stopping context.Context) {
+    prepareProbers(s.db)
+    s.reload()
+    cycleStart := time.Now()
+    cycle := newPollCycle(s.interval)
+    defer func() { s.finishCycle(cycle) }()
+
+    timer := time.NewTimer(s.interval)
+    defer timer.Stop()
+
+    for stopping.Err() == nil {
+        now := time.Now()
+        if now.Sub(cycleStart) >= s.interval {
+            s.finishCycle(cycle)
+            cycle = newPollCycle(s.interval)
+            prepareProbers(s.db)
+            if s.notify == nil {
+                s.reload()
+            }
+            cycleStart = now
+        }
+
+        for len(s.queue) > 0 && !s.queue[0].next.After(now) {
+            e := s.queue[0]
+            switch {
+            case !s.shard.owns(e.target.ID):
+                // Polled by another poller
+            case s.isInFlight(e.target.ID):
+                log.Printf("target %d (%s) is still being polled, skipping", e.target.ID, e.target.Name)
+                cycle.skipped++
+            default:
+                if !s.dispatch(ctx, stopping, cycle, e.target) {
+                    return
+                }
+            }
+
+            // Back to the target's slot: a poll that was late (or made
+            // early for a new target) does not move the following ones, and
+            // polls missed entirely are skipped
+            e.next = s.nextDue(e.target, now.Add(time.Nanosecond))
+            heap.Fix(&s.queue, e.index)
+        }
+
+        wait := cycleStart.Add(s.interval).Sub(time.Now())
+        if len(s.queue) > 0 {
+            if due := time.Until(s.queue[0].next); due < wait {
+                wait = due
+            }
+        }
+        timer.Reset(wait)
+        select {
+        case <-timer.C:
+        case n := <-s.notify:
+            s.applyNotifications(n)
+        case <-stopping.Done():
+        }
+    }
+}
+
+// wait blocks until every dispatched poll has finished and its cycle has
+// been recorded.
+func (s *scheduler) wait() {
+    s.pending.Wait()
+}
+
+// finishCycle records c in the background once its polls are done.
+func (s *scheduler) finishCycle(c *pollCycle) {
+    s.pending.Add(1)
+    go func() {
+        defer s.pending.Done()
+        c.record(s.db)
+    }()
+}
+
+func (s *scheduler) isInFlight(id int) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.inFlight[id]
+}
+
+// reload syncs the queue with all enabled targets.
+func (s *scheduler) reload() {
+    targets, err := loadTargets(s.db)
+    if err != nil {
+        log.Printf("error loading targets: %v", err)
+        return
+    }
+
+    now := time.Now()
+    seen := make(map[int]bool, len(targets))
+    for _, t := range targets {
+        seen[t.ID] = true
+        s.upsert(t, now, false)
+    }
+
+    for id := range s.entries {
+        if !seen[id] {
+            s.remove(id)
+        }
+    }
+
+    if len(targets) == 0 {
+        log.Printf("no enabled targets to poll")
+        return
+    }
+    log.Printf("scheduling %d targets", len(targets))
+}
+
+// applyNotifications applies the target change notification n and any
+// queued behind it. A nil notification (the listener reconnected and may
+// have missed some) or a "*" payload reloads every target.
+func (s *scheduler) applyNotifications(n *pq.Notification) {
+    batch := []*pq.Notification{n}
+drain:
+    for {
+        select {
+        case n := <-s.notify:
+            batch = append(batch, n)
+        default:
+            break drain
+        }
+    }
+
+    changed := make(map[int]bool)
+    for _, n := range batch {
+        if n == nil || n.Extra == "*" {
+            s.reload()
+            return
+        }
+        id, err := strconv.Atoi(n.Extra)
+        if err != nil {
+            log.Printf("ignoring target notification %q", n.Extra)
+            continue
+        }
+        changed[id] = true
+    }
+    s.reloadTargets(changed)
+}
+
+// reloadTargets syncs the queue entries of the given targets. Targets that
+// are new to the queue (added or re-enabled) are polled right away;
+// disabled and deleted ones are removed.
+func (s *scheduler) reloadTargets(ids map[int]bool) {
+    list := make([]int, 0, len(ids))
+    for id := range ids {
+        list = append(list, id)
+    }
+    sort.Ints(list)
+
+    targets, err := loadTargets(s.db, list...)
+    if err != nil {
+        log.Printf("error loading changed targets %v: %v", list, err)
+        return
+    }
+
+    now := time.Now()
+    for _, t := range targets {
+        delete(ids, t.ID)
+        if _, ok := s.entries[t.ID]; !ok {
+            log.Printf("target %d (%s) added, polling now", t.ID, t.Name)
+        }
+        s.upsert(t, now, true)
+    }
+    for id := range ids {
+        if _, ok := s.entries[id]; ok {
+            log.Printf("target %d removed from schedule", id)
+            s.remove(id)
+        }
+    }
+}
+
+// upsert adds t to the queue or updates its entry. A new target is due in
+// its next slot, or now if pollNow is set; a target whose interval changed
+// moves to its new slot.
+func (s *scheduler) upsert(t Target, now time.Time, pollNow bool) {
+    e, ok := s.entries[t.ID]
+    if !ok {
+        e = &scheduleEntry{target: t, next: s.nextDue(t, now)}
+        if pollNow {
+            e.next = now
+        }
+        s.entries[t.ID] = e
+        heap.Push(&s.queue, e)
+        return
+    }
+
+    old := s.targetInterval(e.target)
+    e.target = t
+    if s.targetInterval(t) != old {
+        e.next = s.nextDue(t, now)
+        heap.Fix(&s.queue, e.index)
+    }
+}
+
+func (s *scheduler) remove(id int) {
+    if e, ok := s.entries[id]; ok {
+        heap.Remove(&s.queue, e.index)
+        delete(s.entries, id)
+    }
+}
+
+// nextDue returns the first time at or after now that lies pollOffset into
+// one of t's intervals. Intervals are counted from the Unix epoch, so a
+// target keeps its slot across poller restarts.
+func (s *scheduler) nextDue(t Target, now time.Time) time.Time {
+    interval := s.targetInterval(t)
+    start := now.UnixNano() - now.UnixNano()%int64(interval)
+    due := time.Unix(0, start).Add(pollOffset(t.ID, interval))
+    if due.Before(now) {
+        due = due.Add(interval)
+    }
+    return due
+}
+
+// pollOffset is where in its interval a target is polled. The ID is spread
+// with Fibonacci hashing, which keeps consecutive IDs (the common case)
+// evenly apart, and scaled to [0, interval).
+func pollOffset(id int, interval time.Duration) time.Duration {
+    hi, _ := bits.Mul64(uint64(id)*0x9E3779B97F4A7C15, uint64(interval))
+    return time.Duration(hi)
+}
+
+// dispatch polls t in its own goroutine as part of cycle c, waiting first
+// while maxConcurrent polls are already running. It returns false, without
+// polling, if stopping is done while it waits.
+func (s *scheduler) dispatch(ctx, stopping context.Context, c *pollCycle, t Target) bool {
+    select {
+    case s.sem <- struct{}{}:
+    case <-stopping.Done():
+        return false
+    }
+
+    s.mu.Lock()
+    s.inFlight[t.ID] = true
+    s.mu.Unlock()
+
+    c.attempted++
+    c.polls.Add(1)
+    s.pending.Add(1)
+    go func() {
+        defer s.pending.Done()
+        defer c.polls.Done()
+        defer func() { <-s.sem }()
+        defer func() {
+            s.mu.Lock()
+            delete(s.inFlight, t.ID)
+            s.mu.Unlock()
+        }()
+
+        if pollTarget(ctx, s.db, s.writer, t, s.targetInterval(t)) {
+            c.failed.Add(1)
+        }
+    }()
+    return true
+}
+
+// scheduleQueue is a container/heap of entries, earliest next first.
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q scheduleQueue) Swap(i, j int) {
+    q[i], q[j] = q[j], q[i]
+    q[i].index = i
+    q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+    e := x.(*scheduleEntry)
+    e.index = len(*q)
+    *q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+    old := *q
+    e := old[len(old)-1]
+    old[len(old)-1] = nil
+    *q = old[:len(old)-1]
+    e.index = -1
+    return e
+}
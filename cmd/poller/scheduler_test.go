@@ -0,0 +1,92 @@
+package main
+
+import (
+    "sort"
+    "testing"
+    "time"
+)
+
+func TestPollOffset(t *testing.T) {
+    tests := []struct {
+        id       int
+        interval time.Duration
+    }{
+        {1, time.Minute},
+        {2, time.Minute},
+        {12345, 5 * time.Minute},
+        {1 << 30, time.Hour},
+        {7, time.Second},
+    }
+    for _, tt := range tests {
+        off := pollOffset(tt.id, tt.interval)
+        if off < 0 || off >= tt.interval {
+            t.Errorf("pollOffset(%d, %v) = %v, want within [0, %v)", tt.id, tt.interval, off, tt.interval)
+        }
+        if again := pollOffset(tt.id, tt.interval); again != off {
+            t.Errorf("pollOffset(%d, %v) = %v, then %v; want it stable", tt.id, tt.interval, off, again)
+        }
+    }
+}
+
+func TestPollOffsetSpread(t *testing.T) {
+    // Consecutive IDs should cover the interval evenly: with Fibonacci
+    // hashing no gap between neighbouring offsets exceeds a few times the
+    // even share
+    tests := []struct {
+        first, n int
+        interval time.Duration
+    }{
+        {1, 60, time.Minute},
+        {1, 1000, 5 * time.Minute},
+        {5000, 300, time.Minute},
+    }
+    for _, tt := range tests {
+        offsets := make([]time.Duration, 0, tt.n)
+        for id := tt.first; id < tt.first+tt.n; id++ {
+            offsets = append(offsets, pollOffset(id, tt.interval))
+        }
+        sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+        share := tt.interval / time.Duration(tt.n)
+        maxGap := offsets[0] + tt.interval - offsets[len(offsets)-1] // around the end
+        for i := 1; i < len(offsets); i++ {
+            maxGap = max(maxGap, offsets[i]-offsets[i-1])
+        }
+        if maxGap > 3*share {
+            t.Errorf("IDs %d..%d over %v: largest gap %v, want at most %v",
+                tt.first, tt.first+tt.n-1, tt.interval, maxGap, 3*share)
+        }
+    }
+}
+
+func TestNextDue(t *testing.T) {
+    s := &scheduler{interval: time.Minute}
+    base := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name   string
+        target Target
+        now    time.Time
+    }{
+        {"default interval", Target{ID: 1}, base},
+        {"mid interval", Target{ID: 42}, base.Add(37 * time.Second)},
+        {"own interval", Target{ID: 42, PollInterval: 5 * time.Minute}, base.Add(4 * time.Minute)},
+        {"short interval", Target{ID: 9, PollInterval: 10 * time.Second}, base.Add(123456789)},
+    }
+    for _, tt := range tests {
+        interval := s.targetInterval(tt.target)
+        due := s.nextDue(tt.target, tt.now)
+        if due.Before(tt.now) || !due.Before(tt.now.Add(interval)) {
+            t.Errorf("%s: nextDue = %v, want within [%v, %v)", tt.name, due, tt.now, tt.now.Add(interval))
+        }
+        if got := time.Duration(due.UnixNano() % int64(interval)); got != pollOffset(tt.target.ID, interval) {
+            t.Errorf("%s: nextDue is %v into its interval, want pollOffset %v",
+                tt.name, got, pollOffset(tt.target.ID, interval))
+        }
+        if again := s.nextDue(tt.target, due); !again.Equal(due) {
+            t.Errorf("%s: nextDue(due) = %v, want due itself %v", tt.name, again, due)
+        }
+        if next := s.nextDue(tt.target, due.Add(time.Nanosecond)); next.Sub(due) != interval {
+            t.Errorf("%s: slot after %v is %v, want one interval later", tt.name, due, next)
+        }
+    }
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "hash/fnv"
+    "log"
+    "strings"
+    "sync"
+    "time"
+)
+
+// pollerID identifies this poller instance in poller_leases, poll_results
+// and poll_cycles (AUSPEX_POLLER_ID, default the host name).
+var pollerID = "poller"
+
+// shard divides the targets among the pollers that are alive. Each poller
+// holds a lease in poller_leases and renews it every heartbeat; a poller
+// whose heartbeat stops drops out once its lease expires, and its targets
+// move to the others. A target belongs to the live poller with the highest
+// rendezvous hash score for it, so every poller works out the same
+// assignment on its own, and only the targets of a poller that joins or
+// leaves change hands. Targets keep their slot (see pollOffset) when they
+// move, so their samples stay evenly spaced.
+type shard struct {
+    db        *sql.DB
+    heartbeat time.Duration
+    lease     time.Duration
+    started   time.Time
+
+    mu      sync.RWMutex
+    members []string // live poller IDs, sorted; always includes pollerID
+}
+
+func newShard(db *sql.DB, heartbeat, lease time.Duration) *shard {
+    return &shard{
+        db:        db,
+        heartbeat: heartbeat,
+        lease:     lease,
+        started:   time.Now(),
+        members:   []string{pollerID},
+    }
+}
+
+// owns reports whether targetID is this poller's to poll.
+func (s *shard) owns(targetID int) bool {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    owner, best := "", uint64(0)
+    for _, m := range s.members {
+        if score := rendezvousScore(m, targetID); owner == "" || score > best {
+            owner, best = m, score
+        }
+    }
+    return owner == pollerID
+}
+
+// rendezvousScore is poller's score for targetID, an FNV-1a hash of the
+// poller ID mixed with the target ID through the splitmix64 finalizer.
+func rendezvousScore(poller string, targetID int) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(poller))
+    x := h.Sum64() ^ uint64(targetID)*0x9E3779B97F4A7C15
+    x ^= x >> 30
+    x *= 0xBF58476D1CE4E5B9
+    x ^= x >> 27
+    x *= 0x94D049BB133111EB
+    x ^= x >> 31
+    return x
+}
+
+// run renews the lease every heartbeat until stopping is done.
+func (s *shard) run(stopping context.Context) {
+    ticker := time.NewTicker(s.heartbeat)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            if err := s.renew(); err != nil {
+                log.Printf("error renewing poller lease: %v", err)
+            }
+        case <-stopping.Done():
+            return
+        }
+    }
+}
+
+// renew extends this poller's lease and refreshes the live pollers. Expiry
+// is computed by the database so clock skew between pollers does not matter.
+func (s *shard) renew() error {
+    _, err := s.db.Exec(`
+        INSERT INTO poller_leases (poller_id, started_at, heartbeat_at, expires_at)
+        VALUES ($1, $2::timestamptz, NOW(), NOW() + make_interval(secs => $3))
+        ON CONFLICT (poller_id) DO UPDATE
+        SET started_at = EXCLUDED.started_at, heartbeat_at = NOW(), expires_at = EXCLUDED.expires_at`,
+        pollerID, s.started, s.lease.Seconds())
+    if err != nil {
+        return err
+    }
+
+    rows, err := s.db.Query(`
+        SELECT poller_id FROM poller_leases
+        WHERE expires_at > NOW()
+        ORDER BY poller_id`)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    var members []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return err
+        }
+        members = append(members, id)
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if strings.Join(members, ",") != strings.Join(s.members, ",") {
+        log.Printf("live pollers: %s (this poller is %s)", strings.Join(members, ", "), pollerID)
+        s.members = members
+    }
+    return nil
+}
+
+// release gives up the lease so the other pollers take over this poller's
+// targets right away instead of when the lease expires.
+func (s *shard) release() {
+    if _, err := s.db.Exec(`DELETE FROM poller_leases WHERE poller_id = $1`, pollerID); err != nil {
+        log.Printf("error releasing poller lease: %v", err)
+    }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "regexp"
+    "strconv"
+    "time"
+)
+
+func init() {
+    registerProber("tcp", tcpProber{})
+}
+
+// tcpParams are the check_params of a "tcp" target. The port is the
+// target's own port column.
+type tcpParams struct {
+    TimeoutMs int    `json:"timeout_ms"` // connect, and separately send/read, timeout
+    Send      string `json:"send"`       // written after connecting, e.g. "PING\r\n"
+    Expect    string `json:"expect"`     // regex the response (or banner) must match
+    MaxBytes  int    `json:"max_bytes"`  // stop reading after this many bytes
+}
+
+// tcpProber checks that a TCP port accepts connections. Latency is the
+// connect time. With "expect" set it also reads the response (or the
+// banner the server sends on connect) and matches it against the regex.
+type tcpProber struct{}
+
+func (tcpProber) Probe(ctx context.Context, t Target) PollResult {
+    params := tcpParams{TimeoutMs: 3000, MaxBytes: 4096}
+    if err := decodeParams(t, &params); err != nil {
+        return downResult("%v", err)
+    }
+    timeout := time.Duration(params.TimeoutMs) * time.Millisecond
+
+    var expect *regexp.Regexp
+    if params.Expect != "" {
+        re, err := regexp.Compile(params.Expect)
+        if err != nil {
+            return downResult("invalid expect pattern %q: %v", params.Expect, err)
+        }
+        expect = re
+    }
+
+    addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+    start := time.Now()
+    conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", addr)
+    if err != nil {
+        return downResult("TCP connect to %s failed: %v", addr, err)
+    }
+    defer conn.Close()
+    connectTime := time.Since(start)
+
+    values := map[string]interface{}{
+        "port":       t.Port,
+        "connect_ms": durationMs(connectTime),
+    }
+    result := PollResult{
+        Status:    "up",
+        LatencyMs: int(connectTime.Milliseconds()),
+        Message:   fmt.Sprintf("TCP connect to %s in %.2f ms", addr, durationMs(connectTime)),
+        Data:      values,
+    }
+
+    if params.Send == "" && expect == nil {
+        return result
+    }
+
+    if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+        return downResult("TCP %s: %v", addr, err)
+    }
+    if params.Send != "" {
+        if _, err := conn.Write([]byte(params.Send)); err != nil {
+            return downResult("TCP send to %s failed: %v", addr, err)
+        }
+    }
+    if expect == nil {
+        return result
+    }
+
+    response, err := readUntilMatch(conn, expect, params.MaxBytes)
+    values["response_ms"] = durationMs(time.Since(start) - connectTime)
+    values["response"] = truncate(string(response), 256)
+    if !expect.Match(response) {
+        r := downResult("TCP %s: response %q does not match %q", addr, truncate(string(response), 80), params.Expect)
+        if err != nil {
+            r = downResult("TCP %s: no response matching %q: %v", addr, params.Expect, err)
+        }
+        r.Data = values
+        return r
+    }
+
+    result.Message += fmt.Sprintf(", response matched %q", params.Expect)
+    return result
+}
+
+// readUntilMatch reads from conn until re matches what was received, the
+// peer closes the connection, maxBytes have been read or the deadline set
+// on conn passes. The error is nil on a match or a clean close.
+func readUntilMatch(conn net.Conn, re *regexp.Regexp, maxBytes int) ([]byte, error) {
+    var received []byte
+    buf := make([]byte, 1024)
+    for len(received) < maxBytes {
+        n, err := conn.Read(buf)
+        received = append(received, buf[:n]...)
+        if re.Match(received) {
+            return received, nil
+        }
+        if err != nil {
+            if errors.Is(err, os.ErrDeadlineExceeded) {
+                return received, fmt.Errorf("timed out")
+            }
+            if errors.Is(err, io.EOF) {
+                return received, nil
+            }
+            return received, err
+        }
+    }
+    return received, nil
+}
+
+// truncate shortens s to at most n bytes for messages and stored data.
+func truncate(s string, n int) string {
+    if len(s) <= n {
+        return s
+    }
+    return s[:n] + "..."
+}
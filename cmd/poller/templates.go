@@ -0,0 +1,252 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "math/big"
+    "strconv"
+    "strings"
+    "time"
+
+    gosnmp "github.com/gosnmp/gosnmp"
+    "github.com/lib/pq"
+)
+
+// OIDDefinition is one OID from an OID group (template) assigned to a target.
+// Scalar definitions are fetched with GET; table definitions name a column
+// OID that is walked, with one metric per row index.
+type OIDDefinition struct {
+    ID       int
+    GroupID  int
+    Name     string
+    OID      string
+    Kind     string // "scalar" or "table"
+    DataType string // "gauge", "counter", "integer", "timeticks", "string", "oid", "ipaddress"
+    Units    string
+}
+
+// Metric is a single collected value ready to be written to snmp_metrics.
+// Exactly one of Numeric / Text is set, depending on the definition's type.
+type Metric struct {
+    DefinitionID int
+    OID          string
+    Index        string
+    DataType     string
+    Numeric      *big.Float
+    Text         *string
+}
+
+// loadOIDDefinitions returns the OID definitions of every enabled group,
+// keyed by the target they are assigned to. A nil ids loads every target.
+func loadOIDDefinitions(db *sql.DB, ids []int) (map[int][]OIDDefinition, error) {
+    rows, err := db.Query(`
+        SELECT tog.target_id, d.id, d.group_id, d.name, d.oid, d.kind, d.data_type,
+               COALESCE(d.units, '')
+        FROM target_oid_groups tog
+        JOIN oid_groups g ON g.id = tog.group_id AND g.enabled = true
+        JOIN oid_definitions d ON d.group_id = g.id
+        WHERE $1::int[] IS NULL OR tog.target_id = ANY($1)
+        ORDER BY tog.target_id, d.group_id, d.id`, pq.Array(ids))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := make(map[int][]OIDDefinition)
+    for rows.Next() {
+        var targetID int
+        var d OIDDefinition
+        if err := rows.Scan(&targetID, &d.ID, &d.GroupID, &d.Name, &d.OID, &d.Kind,
+            &d.DataType, &d.Units); err != nil {
+            return nil, err
+        }
+        d.OID = strings.TrimPrefix(d.OID, ".")
+        result[targetID] = append(result[targetID], d)
+    }
+    return result, rows.Err()
+}
+
+// loadTemplateSNMPSettings returns the SNMP client settings of the enabled
+// groups assigned to each target, keyed by target. Where several groups set
+// the same field, the group with the lowest ID wins. A nil ids loads every
+// target.
+func loadTemplateSNMPSettings(db *sql.DB, ids []int) (map[int]SNMPSettings, error) {
+    rows, err := db.Query(`
+        SELECT tog.target_id, ` + snmpSettingsColumns + `
+        FROM target_oid_groups tog
+        JOIN oid_groups g ON g.id = tog.group_id AND g.enabled = true
+        WHERE $1::int[] IS NULL OR tog.target_id = ANY($1)
+        ORDER BY tog.target_id, g.id`, pq.Array(ids))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := make(map[int]SNMPSettings)
+    for rows.Next() {
+        var targetID int
+        var group SNMPSettings
+        if err := rows.Scan(append([]interface{}{&targetID}, group.dest()...)...); err != nil {
+            return nil, err
+        }
+        s := result[targetID]
+        s.inherit(group)
+        result[targetID] = s
+    }
+    return result, rows.Err()
+}
+
+// collectMetrics polls every OID definition assigned to the target over an
+// already-connected session. Failures of individual definitions are logged
+// and skipped so one broken OID does not hide the rest of the template.
+func collectMetrics(g *gosnmp.GoSNMP, t Target) []Metric {
+    var metrics []Metric
+
+    var scalars []OIDDefinition
+    for _, d := range t.OIDs {
+        if d.Kind == "scalar" {
+            scalars = append(scalars, d)
+        }
+    }
+
+    if len(scalars) > 0 {
+        oids := make([]string, len(scalars))
+        for i, d := range scalars {
+            oids[i] = d.OID
+        }
+        vars, err := snmpGet(g, oids)
+        if err != nil {
+            log.Printf("target %d (%s): OID template GET failed: %v", t.ID, t.Name, err)
+        } else {
+            for i, v := range vars {
+                if m, ok := newMetric(scalars[i], "", v); ok {
+                    metrics = append(metrics, m)
+                }
+            }
+        }
+    }
+
+    for _, d := range t.OIDs {
+        if d.Kind != "table" {
+            continue
+        }
+        prefix := "." + d.OID + "."
+        err := snmpWalk(g, d.OID, func(v gosnmp.SnmpPDU) error {
+            index := strings.TrimPrefix(v.Name, prefix)
+            if m, ok := newMetric(d, index, v); ok {
+                metrics = append(metrics, m)
+            }
+            return nil
+        })
+        if err != nil {
+            log.Printf("target %d (%s): walk of %s (%s) failed: %v", t.ID, t.Name, d.Name, d.OID, err)
+        }
+    }
+
+    return metrics
+}
+
+// snmpWalk walks the subtree under root. GetBulk does not exist in SNMPv1,
+// so v1 sessions fall back to GetNext.
+func snmpWalk(g *gosnmp.GoSNMP, root string, fn gosnmp.WalkFunc) error {
+    if g.Version == gosnmp.Version1 {
+        return g.Walk(root, fn)
+    }
+    return g.BulkWalk(root, fn)
+}
+
+// newMetric converts a PDU into a Metric according to the definition's data
+// type. It returns false for varbinds the agent does not implement.
+func newMetric(d OIDDefinition, index string, v gosnmp.SnmpPDU) (Metric, bool) {
+    m := Metric{DefinitionID: d.ID, OID: d.OID, Index: index, DataType: d.DataType}
+
+    switch v.Type {
+    case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+        return m, false
+    }
+
+    switch d.DataType {
+    case "string", "oid", "ipaddress":
+        s := snmpValueToString(v)
+        m.Text = &s
+        return m, true
+    }
+
+    n, ok := pduNumber(v)
+    if !ok {
+        log.Printf("OID %s.%s (%s) returned non-numeric %v value %v", d.OID, index, d.Name, v.Type, v.Value)
+        return m, false
+    }
+    m.Numeric = n
+    return m, true
+}
+
+// pduNumber extracts a numeric value from a PDU. Some MIBs (UCD laLoad, for
+// example) publish numbers as DisplayStrings, so strings are parsed too.
+func pduNumber(v gosnmp.SnmpPDU) (*big.Float, bool) {
+    switch val := v.Value.(type) {
+    case float32:
+        return big.NewFloat(float64(val)), true
+    case float64:
+        return big.NewFloat(val), true
+    case string:
+        return parseNumber(val)
+    case []byte:
+        return parseNumber(string(val))
+    }
+
+    switch v.Type {
+    case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks,
+        gosnmp.Counter64, gosnmp.Uinteger32:
+        return new(big.Float).SetInt(gosnmp.ToBigInt(v.Value)), true
+    }
+    return nil, false
+}
+
+func parseNumber(s string) (*big.Float, bool) {
+    f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+    if err != nil {
+        return nil, false
+    }
+    return big.NewFloat(f), true
+}
+
+// insertMetrics writes all metrics of one poll in a single transaction.
+func insertMetrics(db *sql.DB, targetID int, polledAt time.Time, metrics []Metric) error {
+    if len(metrics) == 0 {
+        return nil
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    stmt, err := tx.Prepare(`
+        INSERT INTO snmp_metrics (target_id, definition_id, oid, oid_index, value_type,
+                                  value_numeric, value_string, polled_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8::timestamptz)
+        ON CONFLICT DO NOTHING`)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+
+    for _, m := range metrics {
+        var numeric, text interface{}
+        if m.Numeric != nil {
+            numeric = m.Numeric.Text('f', -1)
+        }
+        if m.Text != nil {
+            text = *m.Text
+        }
+        if _, err := stmt.Exec(targetID, m.DefinitionID, m.OID, m.Index, m.DataType,
+            numeric, text, polledAt); err != nil {
+            return fmt.Errorf("metric %s.%s: %v", m.OID, m.Index, err)
+        }
+    }
+
+    return tx.Commit()
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "net"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+
+    gosnmp "github.com/gosnmp/gosnmp"
+    "github.com/lib/pq"
+)
+
+// LLDP-MIB (IEEE 802.1AB) and CISCO-CDP-MIB objects.
+const (
+    oidLldpLocChassisIDSubtype = "1.0.8802.1.1.2.1.3.1.0"
+    oidLldpLocChassisID        = "1.0.8802.1.1.2.1.3.2.0"
+    oidLldpLocPortEntry        = "1.0.8802.1.1.2.1.3.7.1"
+    oidLldpRemEntry            = "1.0.8802.1.1.2.1.4.1.1"
+    oidLldpRemManAddrIfSubtype = "1.0.8802.1.1.2.1.4.2.1.3"
+
+    oidCdpCacheEntry = "1.3.6.1.4.1.9.9.23.1.2.1.1"
+)
+
+// lldpLocPortTable and lldpRemTable columns, relative to their entry OIDs.
+const (
+    lldpLocPortID   = 3
+    lldpLocPortDesc = 4
+
+    lldpRemChassisIDSubtype = 4
+    lldpRemChassisID        = 5
+    lldpRemPortIDSubtype    = 6
+    lldpRemPortID           = 7
+    lldpRemPortDesc         = 8
+    lldpRemSysName          = 9
+)
+
+// cdpCacheTable columns, relative to oidCdpCacheEntry.
+const (
+    cdpCacheAddressType = 3
+    cdpCacheAddress     = 4
+    cdpCacheDeviceID    = 6
+    cdpCacheDevicePort  = 7
+    cdpCachePlatform    = 8
+)
+
+// LLDP chassis/port ID subtypes that need special formatting.
+const (
+    lldpSubtypeChassisMAC  = 4
+    lldpSubtypeChassisAddr = 5
+    lldpSubtypePortMAC     = 3
+    lldpSubtypePortAddr    = 4
+)
+
+// Neighbor is one LLDP or CDP neighbor seen on a local port.
+type Neighbor struct {
+    Protocol        string // "lldp" or "cdp"
+    LocalPort       string
+    RemoteChassisID string
+    RemoteSysName   string
+    RemotePort      string
+    RemotePortDescr string
+    RemoteAddress   string
+    RemotePlatform  string
+}
+
+// Topology is the neighbor information collected from one target, along
+// with the target's own LLDP chassis ID so other devices can resolve it.
+// Protocols lists the protocols whose tables were walked successfully; only
+// their links are marked gone when a neighbor is no longer reported.
+type Topology struct {
+    LocalChassisID string
+    Neighbors      []Neighbor
+    Protocols      []string
+}
+
+// collectTopology walks the LLDP remote tables and, where the agent has it,
+// the CDP cache. ifNames maps ifIndex to interface names for the CDP local
+// port; it is walked here when the interface table was not collected. A
+// failed walk of one protocol is logged and the other is still returned;
+// only when both fail is it an error.
+func collectTopology(g *gosnmp.GoSNMP, ifNames map[int]string) (Topology, error) {
+    var topo Topology
+
+    lldpErr := func() error {
+        vars, err := snmpGet(g, []string{oidLldpLocChassisIDSubtype, oidLldpLocChassisID})
+        if err != nil {
+            return fmt.Errorf("lldpLocChassisId: %v", err)
+        }
+        lldp, err := collectLLDP(g)
+        if err != nil {
+            return err
+        }
+        topo.LocalChassisID = formatLLDPID(vars[1], int(pduUint(vars[0])), lldpSubtypeChassisMAC, lldpSubtypeChassisAddr)
+        topo.Neighbors = append(topo.Neighbors, lldp...)
+        topo.Protocols = append(topo.Protocols, "lldp")
+        return nil
+    }()
+
+    cdp, cdpErr := collectCDP(g, ifNames)
+    if cdpErr == nil {
+        topo.Neighbors = append(topo.Neighbors, cdp...)
+        topo.Protocols = append(topo.Protocols, "cdp")
+    }
+
+    switch {
+    case lldpErr != nil && cdpErr != nil:
+        return topo, fmt.Errorf("LLDP: %v; CDP: %v", lldpErr, cdpErr)
+    case lldpErr != nil:
+        log.Printf("LLDP walk on %s failed: %v", g.Target, lldpErr)
+    case cdpErr != nil:
+        log.Printf("CDP walk on %s failed: %v", g.Target, cdpErr)
+    }
+    return topo, nil
+}
+
+// walkTable walks the columns of a conceptual table and calls fn with the
+// column number and the row index (the OID suffix after the column).
+func walkTable(g *gosnmp.GoSNMP, entry string, columns []int, fn func(col int, index string, v gosnmp.SnmpPDU)) error {
+    for _, col := range columns {
+        root := entry + "." + strconv.Itoa(col)
+        prefix := "." + root + "."
+        err := snmpWalk(g, root, func(v gosnmp.SnmpPDU) error {
+            if index := strings.TrimPrefix(v.Name, prefix); index != v.Name {
+                fn(col, index, v)
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func collectLLDP(g *gosnmp.GoSNMP) ([]Neighbor, error) {
+    // Local port names, keyed by lldpLocPortNum
+    localPorts := make(map[string]string)
+    err := walkTable(g, oidLldpLocPortEntry, []int{lldpLocPortID, lldpLocPortDesc}, func(col int, index string, v gosnmp.SnmpPDU) {
+        s := displayOctets(v)
+        if col == lldpLocPortDesc && s != "" {
+            localPorts[index] = s // prefer lldpLocPortDesc
+        } else if _, ok := localPorts[index]; !ok {
+            localPorts[index] = s
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // lldpRemTable is indexed by timeMark.localPortNum.remIndex
+    type row struct {
+        n          Neighbor
+        chassisSub int
+        portSub    int
+        chassisRaw gosnmp.SnmpPDU
+        portRaw    gosnmp.SnmpPDU
+    }
+    rows := make(map[string]*row)
+    var order []string
+
+    columns := []int{lldpRemChassisIDSubtype, lldpRemChassisID, lldpRemPortIDSubtype,
+        lldpRemPortID, lldpRemPortDesc, lldpRemSysName}
+    err = walkTable(g, oidLldpRemEntry, columns, func(col int, index string, v gosnmp.SnmpPDU) {
+        parts := strings.SplitN(index, ".", 3)
+        if len(parts) != 3 {
+            return
+        }
+        key := parts[1] + "." + parts[2]
+        r, ok := rows[key]
+        if !ok {
+            r = &row{n: Neighbor{Protocol: "lldp", LocalPort: localPorts[parts[1]]}}
+            if r.n.LocalPort == "" {
+                r.n.LocalPort = "port " + parts[1]
+            }
+            rows[key] = r
+            order = append(order, key)
+        }
+        switch col {
+        case lldpRemChassisIDSubtype:
+            r.chassisSub = int(pduUint(v))
+        case lldpRemChassisID:
+            r.chassisRaw = v
+        case lldpRemPortIDSubtype:
+            r.portSub = int(pduUint(v))
+        case lldpRemPortID:
+            r.portRaw = v
+        case lldpRemPortDesc:
+            r.n.RemotePortDescr = displayOctets(v)
+        case lldpRemSysName:
+            r.n.RemoteSysName = displayOctets(v)
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // lldpRemManAddrTable: timeMark.localPortNum.remIndex.addrSubtype.addrLen.addr...
+    prefix := "." + oidLldpRemManAddrIfSubtype + "."
+    err = snmpWalk(g, oidLldpRemManAddrIfSubtype, func(v gosnmp.SnmpPDU) error {
+        parts := strings.Split(strings.TrimPrefix(v.Name, prefix), ".")
+        if len(parts) < 5 {
+            return nil
+        }
+        r, ok := rows[parts[1]+"."+parts[2]]
+        if !ok || r.n.RemoteAddress != "" {
+            return nil
+        }
+        r.n.RemoteAddress = indexAddress(parts[3], parts[5:])
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    result := make([]Neighbor, 0, len(order))
+    for _, key := range order {
+        r := rows[key]
+        r.n.RemoteChassisID = formatLLDPID(r.chassisRaw, r.chassisSub, lldpSubtypeChassisMAC, lldpSubtypeChassisAddr)
+        r.n.RemotePort = formatLLDPID(r.portRaw, r.portSub, lldpSubtypePortMAC, lldpSubtypePortAddr)
+        result = append(result, r.n)
+    }
+    return result, nil
+}
+
+func collectCDP(g *gosnmp.GoSNMP, ifNames map[int]string) ([]Neighbor, error) {
+    // cdpCacheTable is indexed by ifIndex.deviceIndex
+    type row struct {
+        n        Neighbor
+        ifIndex  int
+        addrType int
+        addr     []byte
+    }
+    rows := make(map[string]*row)
+    var order []string
+
+    columns := []int{cdpCacheAddressType, cdpCacheAddress, cdpCacheDeviceID, cdpCacheDevicePort, cdpCachePlatform}
+    err := walkTable(g, oidCdpCacheEntry, columns, func(col int, index string, v gosnmp.SnmpPDU) {
+        r, ok := rows[index]
+        if !ok {
+            ifIndex, _ := strconv.Atoi(strings.SplitN(index, ".", 2)[0])
+            r = &row{n: Neighbor{Protocol: "cdp"}, ifIndex: ifIndex}
+            rows[index] = r
+            order = append(order, index)
+        }
+        switch col {
+        case cdpCacheAddressType:
+            r.addrType = int(pduUint(v))
+        case cdpCacheAddress:
+            r.addr, _ = v.Value.([]byte)
+        case cdpCacheDeviceID:
+            r.n.RemoteSysName = displayOctets(v)
+        case cdpCacheDevicePort:
+            r.n.RemotePort = displayOctets(v)
+        case cdpCachePlatform:
+            r.n.RemotePlatform = displayOctets(v)
+        }
+    })
+    if err != nil || len(order) == 0 {
+        return nil, err
+    }
+
+    if len(ifNames) == 0 {
+        ifNames = make(map[int]string)
+        prefix := "." + oidIfDescr + "."
+        if err := snmpWalk(g, oidIfDescr, func(v gosnmp.SnmpPDU) error {
+            if idx, err := strconv.Atoi(strings.TrimPrefix(v.Name, prefix)); err == nil {
+                ifNames[idx] = snmpValueToString(v)
+            }
+            return nil
+        }); err != nil {
+            return nil, fmt.Errorf("ifDescr: %v", err)
+        }
+    }
+
+    result := make([]Neighbor, 0, len(order))
+    for _, key := range order {
+        r := rows[key]
+        r.n.LocalPort = ifNames[r.ifIndex]
+        if r.n.LocalPort == "" {
+            r.n.LocalPort = "ifIndex " + strconv.Itoa(r.ifIndex)
+        }
+        // CDP has no chassis ID; the device ID is the closest equivalent
+        r.n.RemoteChassisID = r.n.RemoteSysName
+        if r.addrType == 1 && (len(r.addr) == 4 || len(r.addr) == 16) { // 1 = ip
+            r.n.RemoteAddress = net.IP(r.addr).String()
+        }
+        result = append(result, r.n)
+    }
+    return result, nil
+}
+
+// formatLLDPID renders an LLDP chassis or port ID according to its subtype:
+// MAC addresses as colon-separated hex, network addresses (IANA family byte
+// followed by the address) as IPs, everything else as text when printable.
+func formatLLDPID(v gosnmp.SnmpPDU, subtype, macSubtype, addrSubtype int) string {
+    b, ok := v.Value.([]byte)
+    if !ok {
+        return snmpValueToString(v)
+    }
+    switch {
+    case subtype == macSubtype && len(b) == 6:
+        return net.HardwareAddr(b).String()
+    case subtype == addrSubtype && len(b) == 5 && b[0] == 1:
+        return net.IP(b[1:]).String()
+    case subtype == addrSubtype && len(b) == 17 && b[0] == 2:
+        return net.IP(b[1:]).String()
+    }
+    return displayOctets(v)
+}
+
+// displayOctets returns an OCTET STRING as text if it is printable and as
+// colon-separated hex otherwise.
+func displayOctets(v gosnmp.SnmpPDU) string {
+    b, ok := v.Value.([]byte)
+    if !ok {
+        return snmpValueToString(v)
+    }
+    s := strings.TrimRight(string(b), "\x00")
+    for _, r := range s {
+        if !unicode.IsPrint(r) {
+            hex := make([]string, len(b))
+            for i, c := range b {
+                hex[i] = fmt.Sprintf("%02x", c)
+            }
+            return strings.Join(hex, ":")
+        }
+    }
+    return s
+}
+
+// indexAddress decodes an InetAddress from OID index sub-identifiers
+// (addrSubtype 1 = IPv4, 2 = IPv6).
+func indexAddress(subtype string, octets []string) string {
+    if (subtype != "1" || len(octets) != 4) && (subtype != "2" || len(octets) != 16) {
+        return ""
+    }
+    ip := make(net.IP, len(octets))
+    for i, o := range octets {
+        n, err := strconv.Atoi(o)
+        if err != nil || n < 0 || n > 255 {
+            return ""
+        }
+        ip[i] = byte(n)
+    }
+    return ip.String()
+}
+
+// storeTopology upserts the target's neighbors into topology_links, marks
+// links that were not seen in this poll as gone and resolves remote ends to
+// targets by chassis ID, management address or sysName.
+func storeTopology(db *sql.DB, targetID int, seenAt time.Time, topo Topology) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // The chassis ID comes from the LLDP local system group
+    if slices.Contains(topo.Protocols, "lldp") {
+        if _, err := tx.Exec(`UPDATE device_inventory SET chassis_id = $2 WHERE target_id = $1`,
+            targetID, topo.LocalChassisID); err != nil {
+            return fmt.Errorf("chassis ID: %v", err)
+        }
+    }
+
+    stmt, err := tx.Prepare(`
+        INSERT INTO topology_links (target_id, protocol, local_port, remote_chassis_id, remote_port,
+                                    remote_sys_name, remote_port_descr, remote_address, remote_platform,
+                                    first_seen, last_seen)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::timestamptz, $10::timestamptz)
+        ON CONFLICT (target_id, protocol, local_port, remote_chassis_id, remote_port) DO UPDATE
+        SET remote_sys_name = EXCLUDED.remote_sys_name,
+            remote_port_descr = EXCLUDED.remote_port_descr,
+            remote_address = EXCLUDED.remote_address,
+            remote_platform = EXCLUDED.remote_platform,
+            last_seen = EXCLUDED.last_seen,
+            gone_at = NULL`)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+
+    nullable := func(s string) interface{} {
+        if s == "" {
+            return nil
+        }
+        return s
+    }
+
+    for _, n := range topo.Neighbors {
+        if _, err := stmt.Exec(targetID, n.Protocol, n.LocalPort, n.RemoteChassisID, n.RemotePort,
+            n.RemoteSysName, nullable(n.RemotePortDescr), nullable(n.RemoteAddress),
+            nullable(n.RemotePlatform), seenAt); err != nil {
+            return fmt.Errorf("%s neighbor on %s: %v", n.Protocol, n.LocalPort, err)
+        }
+    }
+
+    if _, err := tx.Exec(`
+        UPDATE topology_links
+        SET gone_at = $2::timestamptz
+        WHERE target_id = $1 AND last_seen < $2::timestamptz AND gone_at IS NULL
+          AND protocol = ANY($3)`,
+        targetID, seenAt, pq.Array(topo.Protocols)); err != nil {
+        return fmt.Errorf("marking gone links: %v", err)
+    }
+
+    if _, err := tx.Exec(`
+        UPDATE topology_links l
+        SET remote_target_id = (
+            SELECT t.id
+            FROM targets t
+            LEFT JOIN device_inventory i ON i.target_id = t.id
+            WHERE t.id <> l.target_id
+              AND ((l.remote_chassis_id <> '' AND i.chassis_id = l.remote_chassis_id)
+                OR (l.remote_address IS NOT NULL AND t.host = l.remote_address)
+                OR (l.remote_sys_name <> '' AND (lower(t.name) = lower(l.remote_sys_name)
+                                              OR lower(i.sys_name) = lower(l.remote_sys_name))))
+            ORDER BY (i.chassis_id = l.remote_chassis_id) DESC NULLS LAST,
+                     (t.host = l.remote_address) DESC NULLS LAST,
+                     t.id
+            LIMIT 1)
+        WHERE l.target_id = $1 AND l.last_seen = $2::timestamptz`,
+        targetID, seenAt); err != nil {
+        return fmt.Errorf("resolving remote targets: %v", err)
+    }
+
+    return tx.Commit()
+}
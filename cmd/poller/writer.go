@@ -0,0 +1,174 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// resultColumns is the number of bind parameters per poll_results row.
+const resultColumns = 8
+
+// maxBatchSize keeps one INSERT within PostgreSQL's 65535 bind parameters.
+const maxBatchSize = 65535 / resultColumns
+
+// resultWriter writes poll results to poll_results in batches. Poll
+// goroutines hand their results to queue; a single goroutine collects them
+// and writes a batch with one multi-row INSERT once it holds batchSize rows
+// or its first row has waited flushInterval, so a cycle over thousands of
+// targets costs a handful of transactions instead of one per target.
+//
+// The queue is bounded. When the database falls behind, queue blocks, and
+// the pollers holding the concurrency slots wait with it instead of piling
+// up results in memory.
+type resultWriter struct {
+    db            *sql.DB
+    batchSize     int
+    flushInterval time.Duration
+    rows          chan resultRow
+    done          chan struct{} // closed once the last batch is written
+}
+
+// resultRow is one queued poll_results row.
+type resultRow struct {
+    target   Target
+    result   PollResult
+    polledAt time.Time
+}
+
+// newResultWriter starts a writer flushing batches of up to batchSize rows
+// at least every flushInterval.
+func newResultWriter(db *sql.DB, batchSize int, flushInterval time.Duration) *resultWriter {
+    if batchSize > maxBatchSize {
+        batchSize = maxBatchSize
+    }
+    w := &resultWriter{
+        db:            db,
+        batchSize:     batchSize,
+        flushInterval: flushInterval,
+        rows:          make(chan resultRow, 2*batchSize),
+        done:          make(chan struct{}),
+    }
+    go w.run()
+    return w
+}
+
+// queue hands the result of polling t to the writer, waiting while the
+// queue is full. It must not be called after close.
+func (w *resultWriter) queue(t Target, r PollResult) {
+    row := resultRow{target: t, result: r, polledAt: time.Now()}
+    select {
+    case w.rows <- row:
+    default:
+        log.Printf("result writer is falling behind, waiting to queue result for target %d (%s)", t.ID, t.Name)
+        w.rows <- row
+    }
+}
+
+func (w *resultWriter) run() {
+    batch := make([]resultRow, 0, w.batchSize)
+    timer := time.NewTimer(w.flushInterval)
+    timer.Stop()
+
+    for {
+        select {
+        case row, ok := <-w.rows:
+            if !ok {
+                w.flush(batch)
+                close(w.done)
+                return
+            }
+            if len(batch) == 0 {
+                timer.Reset(w.flushInterval)
+            }
+            batch = append(batch, row)
+            if len(batch) < w.batchSize {
+                continue
+            }
+            timer.Stop()
+        case <-timer.C:
+        }
+
+        w.flush(batch)
+        batch = batch[:0]
+    }
+}
+
+// close writes the results still queued and stops the writer.
+func (w *resultWriter) close() {
+    close(w.rows)
+    <-w.done
+}
+
+// flush writes batch with one INSERT. If that fails the rows are retried
+// one at a time, so a single bad row (say, of a target deleted while it was
+// being polled) does not lose the rest of the batch.
+func (w *resultWriter) flush(batch []resultRow) {
+    if len(batch) == 0 {
+        return
+    }
+
+    err := insertResults(w.db, batch)
+    if err == nil {
+        for _, row := range batch {
+            logResult(row)
+        }
+        return
+    }
+
+    log.Printf("error writing batch of %d poll results, retrying one by one: %v", len(batch), err)
+    for i, row := range batch {
+        if err := insertResults(w.db, batch[i:i+1]); err != nil {
+            log.Printf("error inserting poll result for target %d (%s): %v", row.target.ID, row.target.Name, err)
+            continue
+        }
+        logResult(row)
+    }
+}
+
+// insertResults writes rows to poll_results with a single multi-row INSERT.
+// polled_at is passed as timestamptz so it is converted to the session time
+// zone exactly like NOW() would be.
+func insertResults(db *sql.DB, rows []resultRow) error {
+    var values strings.Builder
+    args := make([]interface{}, 0, len(rows)*resultColumns)
+
+    for i, row := range rows {
+        r := row.result
+        var data, errMsg interface{}
+        if r.Data != nil {
+            b, err := json.Marshal(r.Data)
+            if err != nil {
+                return fmt.Errorf("encoding result data for target %d: %v", row.target.ID, err)
+            }
+            data = string(b)
+        }
+        if r.Error != "" {
+            errMsg = r.Error
+        }
+
+        if i > 0 {
+            values.WriteString(", ")
+        }
+        n := len(args)
+        fmt.Fprintf(&values, "($%d, $%d, $%d, $%d, $%d, $%d, $%d::timestamptz, $%d)",
+            n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8)
+        args = append(args, row.target.ID, r.Status, r.LatencyMs, r.Message, errMsg, data, row.polledAt, pollerID)
+    }
+
+    _, err := db.Exec(
+        `INSERT INTO poll_results (target_id, status, latency_ms, message, error, data, polled_at, poller_id)
+         VALUES `+values.String(),
+        args...,
+    )
+    return err
+}
+
+func logResult(row resultRow) {
+    t, r := row.target, row.result
+    log.Printf("polled target %d (%s) host=%s check=%s status=%s latency=%dms msg=%q",
+        t.ID, t.Name, t.Host, t.CheckType, r.Status, r.LatencyMs, r.Message)
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	gosnmp "github.com/gosnmp/gosnmp"
+	_ "github.com/lib/pq"
+
+	"auspex/internal/snmpv3"
+)
+
+// Well-known OIDs of SNMPv2 notifications (RFC 3416 section 4.2.6)
+const (
+	oidSysUpTime   = "1.3.6.1.2.1.1.3.0"
+	oidSnmpTrapOID = "1.3.6.1.6.3.1.1.4.1.0"
+	oidSnmpTraps   = "1.3.6.1.6.3.1.1.5" // generic traps, RFC 3584 section 3.1
+)
+
+// trapNames names the standard traps and the varbinds they carry; other
+// OIDs are stored without a name
+var trapNames = map[string]string{
+	"1.3.6.1.6.3.1.1.5.1":     "coldStart",
+	"1.3.6.1.6.3.1.1.5.2":     "warmStart",
+	"1.3.6.1.6.3.1.1.5.3":     "linkDown",
+	"1.3.6.1.6.3.1.1.5.4":     "linkUp",
+	"1.3.6.1.6.3.1.1.5.5":     "authenticationFailure",
+	"1.3.6.1.6.3.1.1.5.6":     "egpNeighborLoss",
+	"1.3.6.1.2.1.1.3":         "sysUpTime",
+	"1.3.6.1.2.1.1.5":         "sysName",
+	"1.3.6.1.2.1.2.2.1.1":     "ifIndex",
+	"1.3.6.1.2.1.2.2.1.2":     "ifDescr",
+	"1.3.6.1.2.1.2.2.1.3":     "ifType",
+	"1.3.6.1.2.1.2.2.1.7":     "ifAdminStatus",
+	"1.3.6.1.2.1.2.2.1.8":     "ifOperStatus",
+	"1.3.6.1.2.1.31.1.1.1.1":  "ifName",
+	"1.3.6.1.2.1.31.1.1.1.18": "ifAlias",
+	"1.3.6.1.6.3.1.1.4.1":     "snmpTrapOID",
+	"1.3.6.1.6.3.1.1.4.3":     "snmpTrapEnterprise",
+	"1.3.6.1.6.3.18.1.3":      "snmpTrapAddress",
+	"1.3.6.1.6.3.18.1.4":      "snmpTrapCommunity",
+}
+
+// Varbind is one decoded variable of a trap, stored in snmp_traps.varbinds
+type Varbind struct {
+	OID   string      `json:"oid"`
+	Name  string      `json:"name,omitempty"` // e.g. "ifOperStatus.3" for known OIDs
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"` // number for numeric types, string otherwise
+}
+
+// Trap is a received trap or inform, as stored in snmp_traps
+type Trap struct {
+	TargetID   *int
+	Source     string
+	Version    string
+	PDUType    string
+	User       string // SNMPv3 security name
+	TrapOID    string
+	TrapName   string
+	Uptime     *int64
+	Varbinds   []Varbind
+	ReceivedAt time.Time
+}
+
+// targetIndex maps source addresses to targets and is rebuilt on every reload
+type targetIndex struct {
+	mu     sync.RWMutex
+	byAddr map[string]int
+}
+
+func (ix *targetIndex) lookup(addr string) (int, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	id, ok := ix.byAddr[addr]
+	return id, ok
+}
+
+// Configuration
+var (
+	db          *sql.DB
+	listenAddr  string
+	communities map[string]bool // accepted v1/v2c communities, nil accepts any
+	targets     = &targetIndex{byAddr: make(map[string]int)}
+	credentials *gosnmp.SnmpV3SecurityParametersTable
+	loadedCreds = make(map[string]bool) // credentials already in the table
+)
+
+func main() {
+	log.Println("Auspex trap receiver starting...")
+
+	listenAddr = getenv("AUSPEX_TRAPD_LISTEN", "0.0.0.0:162")
+	if list := getenv("AUSPEX_TRAPD_COMMUNITIES", ""); list != "" {
+		communities = make(map[string]bool)
+		for _, c := range strings.Split(list, ",") {
+			communities[strings.TrimSpace(c)] = true
+		}
+	}
+	reloadSeconds, err := strconv.Atoi(getenv("AUSPEX_TRAPD_RELOAD_SECONDS", "60"))
+	if err != nil || reloadSeconds <= 0 {
+		reloadSeconds = 60
+	}
+
+	dbHost := getenv("AUSPEX_DB_HOST", "localhost")
+	dbPort := getenv("AUSPEX_DB_PORT", "5432")
+	dbName := getenv("AUSPEX_DB_NAME", "auspexdb")
+	dbUser := getenv("AUSPEX_DB_USER", "auspex")
+	dbPass := getenv("AUSPEX_DB_PASSWORD", "")
+
+	connStr := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		dbHost, dbPort, dbUser, dbPass, dbName,
+	)
+
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		log.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		log.Fatalf("failed to ping DB: %v", err)
+	}
+
+	// Version 3 only applies to v3 packets; v1 and v2c are decoded as sent
+	params := &gosnmp.GoSNMP{Version: gosnmp.Version3}
+	credentials = gosnmp.NewSnmpV3SecurityParametersTable(params.Logger)
+	params.TrapSecurityParametersTable = credentials
+
+	// v3 informs are sent to this engine, so senders first discover its
+	// engine ID with an empty-user request; answering those needs an ID
+	if id := getenv("AUSPEX_TRAPD_ENGINE_ID", ""); id != "" {
+		engineID, err := hex.DecodeString(strings.TrimPrefix(id, "0x"))
+		if err != nil || len(engineID) < 5 || len(engineID) > 32 {
+			log.Fatalf("AUSPEX_TRAPD_ENGINE_ID must be 5 to 32 bytes of hex")
+		}
+		params.SecurityModel = gosnmp.UserSecurityModel
+		params.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:  string(engineID),
+			AuthenticationProtocol: gosnmp.NoAuth,
+			PrivacyProtocol:        gosnmp.NoPriv,
+		}
+		credentials.Add("", &gosnmp.UsmSecurityParameters{
+			AuthenticationProtocol: gosnmp.NoAuth,
+			PrivacyProtocol:        gosnmp.NoPriv,
+		})
+	}
+
+	if err := reloadTargets(); err != nil {
+		log.Fatalf("failed to load targets: %v", err)
+	}
+	go func() {
+		for range time.Tick(time.Duration(reloadSeconds) * time.Second) {
+			if err := reloadTargets(); err != nil {
+				log.Printf("ERROR: failed to reload targets: %v", err)
+			}
+		}
+	}()
+
+	listener := gosnmp.NewTrapListener()
+	listener.Params = params
+	listener.OnNewTrap = handleTrap
+
+	log.Printf("Trap receiver listening on udp %s (reload=%ds)", listenAddr, reloadSeconds)
+	if err := listener.Listen(listenAddr); err != nil {
+		log.Fatalf("failed to listen on %s: %v", listenAddr, err)
+	}
+}
+
+// reloadTargets rebuilds the source address index and adds the SNMPv3
+// credentials of new or changed targets. The credentials table can only
+// grow; credentials of removed targets stay until the next restart.
+func reloadTargets() error {
+	rows, err := db.Query(`
+		SELECT id, host, check_type, snmp_version,
+		       COALESCE(snmp_security_name, ''), COALESCE(snmp_security_level, ''),
+		       COALESCE(snmp_auth_protocol, ''), COALESCE(snmp_auth_passphrase, ''),
+		       COALESCE(snmp_priv_protocol, ''), COALESCE(snmp_priv_passphrase, '')
+		FROM targets
+		WHERE enabled = true
+		ORDER BY id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type target struct {
+		id                               int
+		host, checkType, version         string
+		user, level, authProto, authPass string
+		privProto, privPass              string
+	}
+	var list []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.id, &t.host, &t.checkType, &t.version, &t.user, &t.level,
+			&t.authProto, &t.authPass, &t.privProto, &t.privPass); err != nil {
+			return err
+		}
+		list = append(list, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// A device may be several targets (e.g. snmp and http); traps belong
+	// to its SNMP target if it has one, else to the lowest ID
+	sort.SliceStable(list, func(i, j int) bool {
+		return isSNMPCheck(list[i].checkType) && !isSNMPCheck(list[j].checkType)
+	})
+
+	byAddr := make(map[string]int)
+	for _, t := range list {
+		addrs := []string{t.host}
+		if net.ParseIP(t.host) == nil {
+			resolved, err := net.LookupHost(t.host)
+			if err != nil {
+				log.Printf("WARNING: cannot resolve target %d host %s: %v", t.id, t.host, err)
+			}
+			addrs = append(addrs, resolved...)
+		}
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				a = ip.String()
+			}
+			if _, taken := byAddr[a]; !taken {
+				byAddr[a] = t.id
+			}
+		}
+
+		if t.version != "3" || t.user == "" {
+			continue
+		}
+		key := strings.Join([]string{t.user, t.level, t.authProto, t.authPass, t.privProto, t.privPass}, "\x00")
+		if loadedCreds[key] {
+			continue
+		}
+		_, usm, err := snmpv3.Credentials{
+			SecurityName:   t.user,
+			SecurityLevel:  t.level,
+			AuthProtocol:   t.authProto,
+			AuthPassphrase: t.authPass,
+			PrivProtocol:   t.privProto,
+			PrivPassphrase: t.privPass,
+		}.USM()
+		if err == nil {
+			err = credentials.Add(t.user, usm)
+		}
+		if err != nil {
+			log.Printf("ERROR: SNMPv3 credentials of target %d: %v", t.id, err)
+			continue
+		}
+		loadedCreds[key] = true
+	}
+
+	targets.mu.Lock()
+	targets.byAddr = byAddr
+	targets.mu.Unlock()
+	return nil
+}
+
+func isSNMPCheck(checkType string) bool {
+	return checkType == "snmp" || checkType == "both"
+}
+
+// handleTrap is called by the listener for every trap and inform; informs
+// are acknowledged by the listener after it returns
+func handleTrap(p *gosnmp.SnmpPacket, addr *net.UDPAddr) {
+	if p.Version != gosnmp.Version3 && communities != nil && !communities[p.Community] {
+		log.Printf("Dropped trap from %s: community not in AUSPEX_TRAPD_COMMUNITIES", addr.IP)
+		return
+	}
+
+	trap := decodeTrap(p, addr)
+	if trap.TargetID == nil {
+		log.Printf("Trap %s from %s does not match any target", describeTrap(trap), trap.Source)
+	}
+
+	id, err := insertTrap(trap)
+	if err != nil {
+		log.Printf("ERROR: failed to store trap from %s: %v", trap.Source, err)
+		return
+	}
+
+	if trap.TargetID != nil {
+		log.Printf("Stored trap #%d %s from %s (target %d)", id, describeTrap(trap), trap.Source, *trap.TargetID)
+	} else {
+		log.Printf("Stored trap #%d %s from %s", id, describeTrap(trap), trap.Source)
+	}
+}
+
+// decodeTrap turns a packet into a Trap. SNMPv1 traps are translated to
+// an snmpTrapOID as described in RFC 3584 section 3.1, so rules can match
+// v1 and v2c/v3 traps alike.
+func decodeTrap(p *gosnmp.SnmpPacket, addr *net.UDPAddr) Trap {
+	trap := Trap{
+		Source:     addr.IP.String(),
+		PDUType:    "trap",
+		ReceivedAt: time.Now(),
+	}
+	if p.PDUType == gosnmp.InformRequest {
+		trap.PDUType = "inform"
+	}
+
+	switch p.Version {
+	case gosnmp.Version1:
+		trap.Version = "1"
+	case gosnmp.Version2c:
+		trap.Version = "2c"
+	case gosnmp.Version3:
+		trap.Version = "3"
+		if usm, ok := p.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+			trap.User = usm.UserName
+		}
+	}
+
+	variables := p.Variables
+	if p.Version == gosnmp.Version1 {
+		enterprise := strings.TrimPrefix(p.Enterprise, ".")
+		if p.GenericTrap >= 0 && p.GenericTrap < 6 {
+			trap.TrapOID = fmt.Sprintf("%s.%d", oidSnmpTraps, p.GenericTrap+1)
+		} else {
+			trap.TrapOID = fmt.Sprintf("%s.0.%d", enterprise, p.SpecificTrap)
+		}
+		uptime := int64(p.Timestamp)
+		trap.Uptime = &uptime
+	}
+
+	for _, v := range variables {
+		oid := strings.TrimPrefix(v.Name, ".")
+		switch oid {
+		case oidSysUpTime:
+			if n, ok := numericValue(v); ok {
+				uptime := n.Int64()
+				trap.Uptime = &uptime
+			}
+			continue
+		case oidSnmpTrapOID:
+			if s, ok := v.Value.(string); ok {
+				trap.TrapOID = strings.TrimPrefix(s, ".")
+			}
+			continue
+		}
+		trap.Varbinds = append(trap.Varbinds, decodeVarbind(v))
+	}
+	trap.TrapName = oidName(trap.TrapOID)
+
+	if id, ok := targets.lookup(trap.Source); ok {
+		trap.TargetID = &id
+	} else if p.Version == gosnmp.Version1 && p.AgentAddress != "" {
+		// The agent-addr field still names the device when a relay forwarded the trap
+		if id, ok := targets.lookup(p.AgentAddress); ok {
+			trap.TargetID = &id
+		}
+	}
+	return trap
+}
+
+func decodeVarbind(v gosnmp.SnmpPDU) Varbind {
+	vb := Varbind{
+		OID:  strings.TrimPrefix(v.Name, "."),
+		Type: v.Type.String(),
+	}
+	vb.Name = oidName(vb.OID)
+
+	switch v.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		if n, ok := numericValue(v); ok {
+			if n.IsInt64() {
+				vb.Value = n.Int64()
+			} else {
+				vb.Value = n.String()
+			}
+		}
+	case gosnmp.OctetString:
+		b, _ := v.Value.([]byte)
+		if utf8.Valid(b) && isPrintable(string(b)) {
+			vb.Value = string(b)
+		} else {
+			vb.Value = hex.EncodeToString(b)
+		}
+	case gosnmp.ObjectIdentifier:
+		s, _ := v.Value.(string)
+		vb.Value = strings.TrimPrefix(s, ".")
+	default:
+		if v.Value != nil {
+			vb.Value = fmt.Sprintf("%v", v.Value)
+		}
+	}
+	return vb
+}
+
+func numericValue(v gosnmp.SnmpPDU) (*big.Int, bool) {
+	switch v.Value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return gosnmp.ToBigInt(v.Value), true
+	}
+	return nil, false
+}
+
+func isPrintable(s string) bool {
+	for _, r := range s {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// oidName names an OID from trapNames, keeping the instance suffix of
+// table columns (e.g. "ifOperStatus.3")
+func oidName(oid string) string {
+	if name, ok := trapNames[oid]; ok {
+		return name
+	}
+	for prefix := oid; ; {
+		i := strings.LastIndexByte(prefix, '.')
+		if i < 0 {
+			return ""
+		}
+		prefix = prefix[:i]
+		if name, ok := trapNames[prefix]; ok {
+			return name + oid[len(prefix):]
+		}
+	}
+}
+
+func describeTrap(t Trap) string {
+	desc := t.TrapOID
+	if t.TrapName != "" {
+		desc = t.TrapName
+	}
+	return fmt.Sprintf("%s (v%s %s)", desc, t.Version, t.PDUType)
+}
+
+// insertTrap stores a trap and notifies listeners on the auspex_traps
+// channel, so the alerter can evaluate trap rules right away
+func insertTrap(t Trap) (int64, error) {
+	varbinds, err := json.Marshal(t.Varbinds)
+	if err != nil {
+		return 0, err
+	}
+	if t.Varbinds == nil {
+		varbinds = []byte("[]")
+	}
+
+	nullable := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+
+	var id int64
+	err = db.QueryRow(`
+		INSERT INTO snmp_traps (target_id, source_address, snmp_version, pdu_type, security_name,
+		                        trap_oid, trap_name, uptime, varbinds, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::timestamptz)
+		RETURNING id
+	`, t.TargetID, t.Source, t.Version, t.PDUType, nullable(t.User), t.TrapOID,
+		nullable(t.TrapName), t.Uptime, string(varbinds), t.ReceivedAt).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := db.Exec(`SELECT pg_notify('auspex_traps', $1)`, strconv.FormatInt(id, 10)); err != nil {
+		log.Printf("ERROR: failed to notify trap #%d: %v", id, err)
+	}
+	return id, nil
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
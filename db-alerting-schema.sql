@@ -28,14 +28,15 @@ CREATE TABLE IF NOT EXISTS alert_rules (
     id              SERIAL PRIMARY KEY,
     target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
     name            VARCHAR(255) NOT NULL,
-    rule_type       VARCHAR(50) NOT NULL DEFAULT 'status_change',  -- Currently only 'status_change'
+    rule_type       VARCHAR(50) NOT NULL DEFAULT 'status_change',  -- 'status_change', 'reboot', 'cert_expiry', 'trap'
     severity        VARCHAR(20) NOT NULL DEFAULT 'critical',       -- 'info', 'warning', 'critical'
     enabled         BOOLEAN NOT NULL DEFAULT true,
     channels        INTEGER[] NOT NULL DEFAULT '{}',               -- Array of alert_channel IDs to notify
+    params          JSONB NOT NULL DEFAULT '{}',                   -- Rule-type settings, e.g. {"days": 14} for 'cert_expiry'
     created_at      TIMESTAMP NOT NULL DEFAULT NOW(),
     updated_at      TIMESTAMP NOT NULL DEFAULT NOW(),
 
-    CONSTRAINT chk_rule_type CHECK (rule_type IN ('status_change', 'latency_threshold', 'consecutive_failures')),
+    CONSTRAINT chk_rule_type CHECK (rule_type IN ('status_change', 'latency_threshold', 'consecutive_failures', 'reboot', 'cert_expiry', 'trap')),
     CONSTRAINT chk_severity CHECK (severity IN ('info', 'warning', 'critical'))
 );
 
@@ -50,7 +51,7 @@ CREATE TABLE IF NOT EXISTS alert_history (
     id                  BIGSERIAL PRIMARY KEY,
     rule_id             INTEGER REFERENCES alert_rules(id) ON DELETE SET NULL,
     target_id           INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
-    alert_type          VARCHAR(50) NOT NULL,       -- 'device_down', 'device_up', etc.
+    alert_type          VARCHAR(50) NOT NULL,       -- 'device_down', 'device_up', 'device_reboot', etc.
     severity            VARCHAR(20) NOT NULL,
     message             TEXT NOT NULL,
     fired_at            TIMESTAMP NOT NULL DEFAULT NOW(),
@@ -126,6 +127,31 @@ CREATE TABLE IF NOT EXISTS alert_state (
     last_state_change   TIMESTAMP
 );
 
+-- ======================================================================
+-- ALERT RULE CURSORS TABLE
+-- Last event processed by event-based rules (e.g. 'reboot'), so each
+-- event is alerted exactly once per rule
+-- ======================================================================
+CREATE TABLE IF NOT EXISTS alert_rule_cursors (
+    rule_id             INTEGER PRIMARY KEY REFERENCES alert_rules(id) ON DELETE CASCADE,
+    last_event_id       BIGINT NOT NULL DEFAULT 0,
+    updated_at          TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- ======================================================================
+-- ALERT CERT EXPIRY TABLE
+-- Certificates a 'cert_expiry' rule has alerted on; the row is removed and
+-- the alert resolved once the target no longer serves the certificate
+-- ======================================================================
+CREATE TABLE IF NOT EXISTS alert_cert_expiry (
+    rule_id             INTEGER NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+    fingerprint_sha256  CHAR(64) NOT NULL,
+    alert_id            BIGINT REFERENCES alert_history(id) ON DELETE SET NULL,
+    created_at          TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (rule_id, fingerprint_sha256)
+);
+
 -- ======================================================================
 -- SAMPLE ALERT CHANNEL CONFIGURATIONS
 -- ======================================================================
@@ -2,6 +2,22 @@
 -- PostgreSQL 12+
 
 -- Drop existing tables if they exist (careful in production!)
+DROP TABLE IF EXISTS poller_leases CASCADE;
+DROP TABLE IF EXISTS poll_cycles CASCADE;
+DROP TABLE IF EXISTS snmp_traps CASCADE;
+DROP TABLE IF EXISTS tls_certificates CASCADE;
+DROP TABLE IF EXISTS topology_links CASCADE;
+DROP TABLE IF EXISTS device_inventory_history CASCADE;
+DROP TABLE IF EXISTS device_inventory CASCADE;
+DROP TABLE IF EXISTS device_fingerprints CASCADE;
+DROP TABLE IF EXISTS reboot_events CASCADE;
+DROP TABLE IF EXISTS target_uptime CASCADE;
+DROP TABLE IF EXISTS interface_stats CASCADE;
+DROP TABLE IF EXISTS interface_counters CASCADE;
+DROP TABLE IF EXISTS snmp_metrics CASCADE;
+DROP TABLE IF EXISTS target_oid_groups CASCADE;
+DROP TABLE IF EXISTS oid_definitions CASCADE;
+DROP TABLE IF EXISTS oid_groups CASCADE;
 DROP TABLE IF EXISTS poll_results CASCADE;
 DROP TABLE IF EXISTS targets CASCADE;
 
@@ -16,13 +32,49 @@ CREATE TABLE targets (
     port            INTEGER NOT NULL DEFAULT 161,
     community       VARCHAR(100) NOT NULL DEFAULT 'public',
     snmp_version    VARCHAR(20) NOT NULL DEFAULT '2c',
+    check_type      VARCHAR(20) NOT NULL DEFAULT 'snmp',   -- prober to use, see CHECK-TYPES.md
+    check_params    JSONB NOT NULL DEFAULT '{}',           -- check-specific settings, e.g. {"expect": "^SSH-"}
+
+    -- SNMPv3 (USM) credentials, only used when snmp_version = '3'
+    snmp_security_name   VARCHAR(100),
+    snmp_security_level  VARCHAR(20),            -- 'noAuthNoPriv', 'authNoPriv', 'authPriv'
+    snmp_auth_protocol   VARCHAR(20),            -- 'MD5', 'SHA', 'SHA-224', 'SHA-256', 'SHA-384', 'SHA-512'
+    snmp_auth_passphrase VARCHAR(255),
+    snmp_priv_protocol   VARCHAR(20),            -- 'DES', 'AES-128', 'AES-192', 'AES-256' (+ 'AES-192C', 'AES-256C' for Cisco)
+    snmp_priv_passphrase VARCHAR(255),
+    snmp_context_name    VARCHAR(100),
+
+    collect_interfaces   BOOLEAN NOT NULL DEFAULT true,   -- walk ifTable/ifXTable each poll
+    collect_topology     BOOLEAN NOT NULL DEFAULT true,   -- walk LLDP/CDP neighbor tables each poll
+    poll_interval_seconds INTEGER,                        -- NULL polls every AUSPEX_POLL_INTERVAL_SECONDS
+
+    -- SNMP client overrides, NULL inherits from the assigned OID groups (templates)
+    snmp_timeout_ms          INTEGER,                 -- per attempt, default 2000
+    snmp_retries             INTEGER,                 -- default 1
+    snmp_exponential_backoff BOOLEAN,                 -- double the timeout on every retry, default false
+    snmp_transport           VARCHAR(3),              -- 'udp' (default) or 'tcp'
+    snmp_max_oids            INTEGER,                 -- varbinds per GET, default 3
+    snmp_max_repetitions     INTEGER,                 -- GetBulk max-repetitions, default 50
+    snmp_source_address      INET,                    -- local IP to poll from on multi-homed pollers
+
     enabled         BOOLEAN NOT NULL DEFAULT true,
     created_at      TIMESTAMP NOT NULL DEFAULT NOW(),
     updated_at      TIMESTAMP NOT NULL DEFAULT NOW(),
 
     -- Constraints
     CONSTRAINT chk_port CHECK (port > 0 AND port <= 65535),
-    CONSTRAINT chk_snmp_version CHECK (snmp_version IN ('1', '2c', '3'))
+    CONSTRAINT chk_snmp_version CHECK (snmp_version IN ('1', '2c', '3')),
+    CONSTRAINT chk_check_type CHECK (check_type IN ('snmp', 'icmp', 'both', 'tcp', 'http', 'dns', 'ntp', 'exec')),
+    CONSTRAINT chk_snmp_security_level CHECK (snmp_security_level IN ('noAuthNoPriv', 'authNoPriv', 'authPriv')),
+    CONSTRAINT chk_snmp_auth_protocol CHECK (snmp_auth_protocol IN ('MD5', 'SHA', 'SHA-224', 'SHA-256', 'SHA-384', 'SHA-512')),
+    CONSTRAINT chk_snmp_priv_protocol CHECK (snmp_priv_protocol IN ('DES', 'AES-128', 'AES-192', 'AES-256', 'AES-192C', 'AES-256C')),
+    CONSTRAINT chk_snmp_v3_user CHECK (snmp_version <> '3' OR snmp_security_name IS NOT NULL),
+    CONSTRAINT chk_poll_interval CHECK (poll_interval_seconds > 0),
+    CONSTRAINT chk_snmp_timeout CHECK (snmp_timeout_ms > 0),
+    CONSTRAINT chk_snmp_retries CHECK (snmp_retries >= 0),
+    CONSTRAINT chk_snmp_transport CHECK (snmp_transport IN ('udp', 'tcp')),
+    CONSTRAINT chk_snmp_max_oids CHECK (snmp_max_oids > 0),
+    CONSTRAINT chk_snmp_max_repetitions CHECK (snmp_max_repetitions > 0)
 );
 
 -- Index for querying enabled targets (used by poller)
@@ -40,11 +92,14 @@ CREATE TABLE poll_results (
     target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
     status          VARCHAR(20) NOT NULL,
     latency_ms      INTEGER NOT NULL DEFAULT 0,
-    message         TEXT,
+    message         TEXT,                           -- Human-readable summary
+    error           TEXT,                           -- Failure description (NULL when the poll succeeded)
+    data            JSONB,                          -- Typed collected values, e.g. {"sys_name": ..., "sys_uptime": 123}
     polled_at       TIMESTAMP NOT NULL DEFAULT NOW(),
+    poller_id       VARCHAR(100),                   -- Poller that produced the result
 
     -- Constraints
-    CONSTRAINT chk_status CHECK (status IN ('up', 'down', 'unknown')),
+    CONSTRAINT chk_status CHECK (status IN ('up', 'degraded', 'down', 'unknown')),
     CONSTRAINT chk_latency CHECK (latency_ms >= 0)
 );
 
@@ -57,6 +112,366 @@ CREATE INDEX idx_poll_results_polled_at ON poll_results(polled_at DESC);
 -- Index for status filtering
 CREATE INDEX idx_poll_results_status ON poll_results(status);
 
+-- ======================================================================
+-- OID GROUPS (TEMPLATES)
+-- Reusable sets of OIDs that are collected from every assigned target
+-- ======================================================================
+CREATE TABLE oid_groups (
+    id              SERIAL PRIMARY KEY,
+    name            VARCHAR(100) NOT NULL UNIQUE,
+    description     TEXT,
+    enabled         BOOLEAN NOT NULL DEFAULT true,
+
+    -- SNMP client settings inherited by assigned targets that do not set their own
+    snmp_timeout_ms          INTEGER,
+    snmp_retries             INTEGER,
+    snmp_exponential_backoff BOOLEAN,
+    snmp_transport           VARCHAR(3),
+    snmp_max_oids            INTEGER,
+    snmp_max_repetitions     INTEGER,
+    snmp_source_address      INET,
+
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    -- Constraints
+    CONSTRAINT chk_snmp_timeout CHECK (snmp_timeout_ms > 0),
+    CONSTRAINT chk_snmp_retries CHECK (snmp_retries >= 0),
+    CONSTRAINT chk_snmp_transport CHECK (snmp_transport IN ('udp', 'tcp')),
+    CONSTRAINT chk_snmp_max_oids CHECK (snmp_max_oids > 0),
+    CONSTRAINT chk_snmp_max_repetitions CHECK (snmp_max_repetitions > 0)
+);
+
+-- ======================================================================
+-- OID_DEFINITIONS TABLE
+-- OIDs within each group. Scalars are fetched with GET, table columns are
+-- walked and produce one metric per row index.
+-- ======================================================================
+CREATE TABLE oid_definitions (
+    id              SERIAL PRIMARY KEY,
+    group_id        INTEGER NOT NULL REFERENCES oid_groups(id) ON DELETE CASCADE,
+    name            VARCHAR(100) NOT NULL,
+    oid             VARCHAR(255) NOT NULL,
+    kind            VARCHAR(10) NOT NULL DEFAULT 'scalar',
+    data_type       VARCHAR(20) NOT NULL DEFAULT 'gauge',
+    units           VARCHAR(50),
+    description     TEXT,
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    -- Constraints
+    CONSTRAINT uq_oid_definitions_group_oid UNIQUE (group_id, oid),
+    CONSTRAINT chk_oid_kind CHECK (kind IN ('scalar', 'table')),
+    CONSTRAINT chk_oid_data_type CHECK (data_type IN ('gauge', 'counter', 'integer', 'timeticks', 'string', 'oid', 'ipaddress'))
+);
+
+CREATE INDEX idx_oid_definitions_group ON oid_definitions(group_id);
+
+-- ======================================================================
+-- TARGET_OID_GROUPS TABLE
+-- Assigns OID groups to targets (a target may use several groups)
+-- ======================================================================
+CREATE TABLE target_oid_groups (
+    target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    group_id        INTEGER NOT NULL REFERENCES oid_groups(id) ON DELETE CASCADE,
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (target_id, group_id)
+);
+
+-- ======================================================================
+-- SNMP_METRICS TABLE
+-- Typed values collected from OID groups, one row per OID/index per poll
+-- ======================================================================
+CREATE TABLE snmp_metrics (
+    target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    definition_id   INTEGER REFERENCES oid_definitions(id) ON DELETE SET NULL,
+    oid             VARCHAR(255) NOT NULL,
+    oid_index       VARCHAR(255) NOT NULL DEFAULT '',   -- '' for scalars, row index for table columns
+    value_type      VARCHAR(20) NOT NULL,
+    value_numeric   NUMERIC,                            -- gauge / counter / integer / timeticks
+    value_string    TEXT,                               -- string / oid / ipaddress
+    polled_at       TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (target_id, oid, oid_index, polled_at)
+);
+
+-- Index for fetching the latest values of a target
+CREATE INDEX idx_snmp_metrics_target_polled ON snmp_metrics(target_id, polled_at DESC);
+
+-- Index for time-based queries and retention
+CREATE INDEX idx_snmp_metrics_polled_at ON snmp_metrics(polled_at DESC);
+
+-- ======================================================================
+-- INTERFACE_COUNTERS TABLE
+-- Last raw IF-MIB counter sample per interface, used to compute rates
+-- (kept in the database so rates survive a poller restart)
+-- ======================================================================
+CREATE TABLE interface_counters (
+    target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    if_index        INTEGER NOT NULL,
+    sys_uptime      BIGINT NOT NULL,                -- sysUpTime (centiseconds) at sample time
+    in_octets       NUMERIC(20, 0) NOT NULL,
+    out_octets      NUMERIC(20, 0) NOT NULL,
+    counter_bits    SMALLINT NOT NULL,              -- 64 = ifHC* counters, 32 = ifTable counters
+    in_errors       BIGINT NOT NULL,
+    out_discards    BIGINT NOT NULL,
+    sampled_at      TIMESTAMP NOT NULL,
+
+    PRIMARY KEY (target_id, if_index),
+    CONSTRAINT chk_counter_bits CHECK (counter_bits IN (32, 64))
+);
+
+-- ======================================================================
+-- INTERFACE_STATS TABLE
+-- Per-interface rates computed from counter deltas, one row per poll
+-- ======================================================================
+CREATE TABLE interface_stats (
+    target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    if_index        INTEGER NOT NULL,
+    if_descr        TEXT,
+    if_alias        TEXT,
+    oper_status     SMALLINT,                       -- ifOperStatus: 1=up, 2=down, 3=testing, ...
+    in_bps          DOUBLE PRECISION,               -- NULL on first sample or after a counter reset
+    out_bps         DOUBLE PRECISION,
+    in_errors_ps    DOUBLE PRECISION,
+    out_discards_ps DOUBLE PRECISION,
+    polled_at       TIMESTAMP NOT NULL,
+
+    PRIMARY KEY (target_id, if_index, polled_at)
+);
+
+CREATE INDEX idx_interface_stats_target_polled ON interface_stats(target_id, polled_at DESC);
+
+-- ======================================================================
+-- TARGET_UPTIME TABLE
+-- sysUpTime from the previous poll, used to detect reboots
+-- ======================================================================
+CREATE TABLE target_uptime (
+    target_id       INTEGER PRIMARY KEY REFERENCES targets(id) ON DELETE CASCADE,
+    sys_uptime      BIGINT NOT NULL,                -- sysUpTime (centiseconds)
+    sampled_at      TIMESTAMP NOT NULL
+);
+
+-- ======================================================================
+-- REBOOT_EVENTS TABLE
+-- Reboots detected from sysUpTime going backwards between two polls
+-- ======================================================================
+CREATE TABLE reboot_events (
+    id              BIGSERIAL PRIMARY KEY,
+    target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    boot_time       TIMESTAMP NOT NULL,             -- estimated: poll time - current sysUpTime
+    previous_uptime BIGINT NOT NULL,                -- centiseconds
+    current_uptime  BIGINT NOT NULL,                -- centiseconds
+    detected_at     TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_reboot_events_target ON reboot_events(target_id, id);
+
+-- ======================================================================
+-- DEVICE_FINGERPRINTS TABLE
+-- Site-specific additions to the fingerprint database bundled with the
+-- poller. Longest oid_prefix wins; on a tie these rows win over builtins.
+-- ======================================================================
+CREATE TABLE device_fingerprints (
+    id              SERIAL PRIMARY KEY,
+    oid_prefix      VARCHAR(255) NOT NULL,          -- sysObjectID prefix, e.g. '1.3.6.1.4.1.9.1'
+    descr_pattern   VARCHAR(255),                   -- optional case-insensitive regex on sysDescr
+    vendor          VARCHAR(100) NOT NULL,
+    model_family    VARCHAR(100),
+    os              VARCHAR(100),
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- ======================================================================
+-- DEVICE_INVENTORY TABLE
+-- Current identity of each device, refreshed on every successful poll
+-- ======================================================================
+CREATE TABLE device_inventory (
+    target_id       INTEGER PRIMARY KEY REFERENCES targets(id) ON DELETE CASCADE,
+    sys_object_id   VARCHAR(255) NOT NULL DEFAULT '',
+    sys_name        TEXT NOT NULL DEFAULT '',
+    sys_descr       TEXT NOT NULL DEFAULT '',
+    sys_contact     TEXT NOT NULL DEFAULT '',
+    sys_location    TEXT NOT NULL DEFAULT '',
+    vendor          VARCHAR(100) NOT NULL DEFAULT '',
+    model_family    VARCHAR(100) NOT NULL DEFAULT '',
+    os              VARCHAR(100) NOT NULL DEFAULT '',
+    chassis_id      VARCHAR(255) NOT NULL DEFAULT '',   -- lldpLocChassisId, used to resolve neighbors
+    first_seen      TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_seen       TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_device_inventory_vendor ON device_inventory(vendor);
+
+-- ======================================================================
+-- DEVICE_INVENTORY_HISTORY TABLE
+-- One row per attribute change (OS upgrade, relocation, hardware swap)
+-- ======================================================================
+CREATE TABLE device_inventory_history (
+    id              BIGSERIAL PRIMARY KEY,
+    target_id       INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    attribute       VARCHAR(50) NOT NULL,
+    old_value       TEXT,
+    new_value       TEXT,
+    changed_at      TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_device_inventory_history_target ON device_inventory_history(target_id, changed_at DESC);
+
+-- ======================================================================
+-- TOPOLOGY_LINKS TABLE
+-- LLDP/CDP neighbors seen on each target. last_seen advances on every poll
+-- that still reports the link; gone_at is set once a poll no longer does.
+-- remote_target_id is the target the far end resolved to, if any.
+-- ======================================================================
+CREATE TABLE topology_links (
+    id                  BIGSERIAL PRIMARY KEY,
+    target_id           INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    protocol            VARCHAR(10) NOT NULL,           -- 'lldp' or 'cdp'
+    local_port          VARCHAR(255) NOT NULL,
+    remote_chassis_id   VARCHAR(255) NOT NULL DEFAULT '',
+    remote_port         VARCHAR(255) NOT NULL DEFAULT '',
+    remote_sys_name     VARCHAR(255) NOT NULL DEFAULT '',
+    remote_port_descr   TEXT,
+    remote_address      VARCHAR(64),
+    remote_platform     TEXT,
+    remote_target_id    INTEGER REFERENCES targets(id) ON DELETE SET NULL,
+    first_seen          TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_seen           TIMESTAMP NOT NULL DEFAULT NOW(),
+    gone_at             TIMESTAMP,
+
+    -- Constraints
+    CONSTRAINT uq_topology_links UNIQUE (target_id, protocol, local_port, remote_chassis_id, remote_port),
+    CONSTRAINT chk_topology_protocol CHECK (protocol IN ('lldp', 'cdp'))
+);
+
+CREATE INDEX idx_topology_links_remote ON topology_links(remote_target_id);
+CREATE INDEX idx_topology_links_gone ON topology_links(gone_at) WHERE gone_at IS NOT NULL;
+
+-- ======================================================================
+-- TLS_CERTIFICATES TABLE
+-- Certificates presented to "http" checks, one row per certificate and
+-- target. The whole chain of a poll shares last_seen, so the chain a
+-- target currently serves is the rows with its latest last_seen.
+-- ======================================================================
+CREATE TABLE tls_certificates (
+    id                  BIGSERIAL PRIMARY KEY,
+    target_id           INTEGER NOT NULL REFERENCES targets(id) ON DELETE CASCADE,
+    fingerprint_sha256  CHAR(64) NOT NULL,              -- hex SHA-256 of the DER certificate
+    chain_position      INTEGER NOT NULL,               -- 0 = leaf, in the order the server sent it
+    subject             TEXT NOT NULL,
+    issuer              TEXT NOT NULL,
+    serial_number       VARCHAR(128) NOT NULL,
+    sans                TEXT[] NOT NULL DEFAULT '{}',   -- DNS names, IPs, emails, URIs
+    not_before          TIMESTAMP NOT NULL,
+    not_after           TIMESTAMP NOT NULL,
+    first_seen          TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_seen           TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    -- Constraints
+    CONSTRAINT uq_tls_certificates UNIQUE (target_id, fingerprint_sha256)
+);
+
+CREATE INDEX idx_tls_certificates_seen ON tls_certificates(target_id, last_seen DESC);
+
+-- ======================================================================
+-- SNMP_TRAPS TABLE
+-- Traps and informs received by trapd. target_id is the target the source
+-- address belongs to, NULL for unknown senders. SNMPv1 traps are stored
+-- with the snmpTrapOID they translate to (RFC 3584).
+-- ======================================================================
+CREATE TABLE snmp_traps (
+    id                  BIGSERIAL PRIMARY KEY,
+    target_id           INTEGER REFERENCES targets(id) ON DELETE SET NULL,
+    source_address      VARCHAR(64) NOT NULL,
+    snmp_version        VARCHAR(20) NOT NULL,           -- '1', '2c' or '3'
+    pdu_type            VARCHAR(10) NOT NULL,           -- 'trap' or 'inform'
+    security_name       VARCHAR(255),                   -- SNMPv3 user
+    trap_oid            VARCHAR(255) NOT NULL,          -- e.g. 1.3.6.1.6.3.1.1.5.3 (linkDown)
+    trap_name           VARCHAR(255),                   -- name of well-known trap OIDs
+    uptime              BIGINT,                         -- sysUpTime (centiseconds) of the sender
+    varbinds            JSONB NOT NULL DEFAULT '[]',    -- [{"oid", "name", "type", "value"}, ...]
+    received_at         TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    -- Constraints
+    CONSTRAINT chk_trap_pdu_type CHECK (pdu_type IN ('trap', 'inform'))
+);
+
+CREATE INDEX idx_snmp_traps_target ON snmp_traps(target_id, id DESC);
+CREATE INDEX idx_snmp_traps_received_at ON snmp_traps(received_at DESC);
+
+-- ======================================================================
+-- POLL_CYCLES TABLE
+-- One row per scheduler cycle (AUSPEX_POLL_INTERVAL_SECONDS), written once
+-- the polls started in it have finished. duration_ms well above the interval
+-- or skipped > 0 means the poller is saturated.
+-- ======================================================================
+CREATE TABLE poll_cycles (
+    id                  BIGSERIAL PRIMARY KEY,
+    poller_id           VARCHAR(100),
+    started_at          TIMESTAMP NOT NULL,
+    duration_ms         INTEGER NOT NULL,               -- until the cycle's last poll finished
+    interval_seconds    INTEGER NOT NULL,               -- length of the cycle
+    attempted           INTEGER NOT NULL DEFAULT 0,     -- polls started
+    skipped             INTEGER NOT NULL DEFAULT 0,     -- due targets still being polled
+    failed              INTEGER NOT NULL DEFAULT 0      -- polls that came back down or unknown
+);
+
+CREATE INDEX idx_poll_cycles_started_at ON poll_cycles(started_at DESC);
+
+-- ======================================================================
+-- POLLER_LEASES TABLE
+-- One row per running poller. Each poller renews its lease every
+-- AUSPEX_POLLER_HEARTBEAT_SECONDS; the pollers with an unexpired lease
+-- divide the targets between them by rendezvous hashing, so a poller whose
+-- heartbeat stops loses its targets to the others when its lease expires.
+-- ======================================================================
+CREATE TABLE poller_leases (
+    poller_id       VARCHAR(100) PRIMARY KEY,       -- AUSPEX_POLLER_ID
+    started_at      TIMESTAMP NOT NULL,
+    heartbeat_at    TIMESTAMP NOT NULL,
+    expires_at      TIMESTAMP NOT NULL
+);
+
+-- ======================================================================
+-- TARGET CHANGE NOTIFICATIONS
+-- The poller LISTENs on auspex_targets and reloads only the targets that
+-- changed. The payload is the target id, taken from the column named by the
+-- trigger argument, or '*' when a change (to an OID group) may affect any
+-- target.
+-- ======================================================================
+CREATE OR REPLACE FUNCTION notify_target_change() RETURNS trigger AS $$
+DECLARE
+    target_id TEXT := '*';
+BEGIN
+    IF TG_NARGS > 0 THEN
+        IF TG_OP = 'DELETE' THEN
+            target_id := to_jsonb(OLD) ->> TG_ARGV[0];
+        ELSE
+            target_id := to_jsonb(NEW) ->> TG_ARGV[0];
+        END IF;
+    END IF;
+    PERFORM pg_notify('auspex_targets', target_id);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_targets_notify
+    AFTER INSERT OR UPDATE OR DELETE ON targets
+    FOR EACH ROW EXECUTE FUNCTION notify_target_change('id');
+
+CREATE TRIGGER trg_target_oid_groups_notify
+    AFTER INSERT OR UPDATE OR DELETE ON target_oid_groups
+    FOR EACH ROW EXECUTE FUNCTION notify_target_change('target_id');
+
+CREATE TRIGGER trg_oid_groups_notify
+    AFTER INSERT OR UPDATE OR DELETE ON oid_groups
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_target_change();
+
+CREATE TRIGGER trg_oid_definitions_notify
+    AFTER INSERT OR UPDATE OR DELETE ON oid_definitions
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_target_change();
+
 -- ======================================================================
 -- SAMPLE DATA (optional - comment out if not needed)
 -- ======================================================================
@@ -76,6 +491,42 @@ INSERT INTO poll_results (target_id, status, latency_ms, message, polled_at) VAL
     (2, 'down', 0, 'SNMP timeout', NOW() - INTERVAL '1 minute'),
     (3, 'up', 67, 'sysName="edge-fw" sysDescr="Fortinet" sysUpTime="55555555"', NOW() - INTERVAL '2 minutes');
 
+-- Pre-built OID groups
+INSERT INTO oid_groups (name, description) VALUES
+    ('ucd-snmp-linux', 'Net-SNMP (UCD-SNMP-MIB) load average, memory and CPU idle'),
+    ('host-resources', 'HOST-RESOURCES-MIB processes, storage and processor load'),
+    ('cisco-ios', 'CISCO-PROCESS-MIB CPU and CISCO-MEMORY-POOL-MIB memory'),
+    ('ups-rfc1628', 'UPS-MIB (RFC 1628) battery and output load')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO oid_definitions (group_id, name, oid, kind, data_type, units)
+SELECT g.id, d.name, d.oid, d.kind, d.data_type, d.units
+FROM oid_groups g
+JOIN (VALUES
+    ('ucd-snmp-linux', 'laLoad1', '1.3.6.1.4.1.2021.10.1.3.1', 'scalar', 'gauge', NULL),
+    ('ucd-snmp-linux', 'laLoad5', '1.3.6.1.4.1.2021.10.1.3.2', 'scalar', 'gauge', NULL),
+    ('ucd-snmp-linux', 'laLoad15', '1.3.6.1.4.1.2021.10.1.3.3', 'scalar', 'gauge', NULL),
+    ('ucd-snmp-linux', 'memTotalReal', '1.3.6.1.4.1.2021.4.5.0', 'scalar', 'gauge', 'kB'),
+    ('ucd-snmp-linux', 'memAvailReal', '1.3.6.1.4.1.2021.4.6.0', 'scalar', 'gauge', 'kB'),
+    ('ucd-snmp-linux', 'ssCpuIdle', '1.3.6.1.4.1.2021.11.11.0', 'scalar', 'gauge', '%'),
+    ('host-resources', 'hrSystemProcesses', '1.3.6.1.2.1.25.1.6.0', 'scalar', 'gauge', NULL),
+    ('host-resources', 'hrStorageDescr', '1.3.6.1.2.1.25.2.3.1.3', 'table', 'string', NULL),
+    ('host-resources', 'hrStorageAllocationUnits', '1.3.6.1.2.1.25.2.3.1.4', 'table', 'integer', 'bytes'),
+    ('host-resources', 'hrStorageSize', '1.3.6.1.2.1.25.2.3.1.5', 'table', 'gauge', 'units'),
+    ('host-resources', 'hrStorageUsed', '1.3.6.1.2.1.25.2.3.1.6', 'table', 'gauge', 'units'),
+    ('host-resources', 'hrProcessorLoad', '1.3.6.1.2.1.25.3.3.1.2', 'table', 'gauge', '%'),
+    ('cisco-ios', 'cpmCPUTotal1minRev', '1.3.6.1.4.1.9.9.109.1.1.1.1.7', 'table', 'gauge', '%'),
+    ('cisco-ios', 'cpmCPUTotal5minRev', '1.3.6.1.4.1.9.9.109.1.1.1.1.8', 'table', 'gauge', '%'),
+    ('cisco-ios', 'ciscoMemoryPoolUsed', '1.3.6.1.4.1.9.9.48.1.1.1.5', 'table', 'gauge', 'bytes'),
+    ('cisco-ios', 'ciscoMemoryPoolFree', '1.3.6.1.4.1.9.9.48.1.1.1.6', 'table', 'gauge', 'bytes'),
+    ('ups-rfc1628', 'upsBatteryStatus', '1.3.6.1.2.1.33.1.2.1.0', 'scalar', 'integer', NULL),
+    ('ups-rfc1628', 'upsEstimatedMinutesRemaining', '1.3.6.1.2.1.33.1.2.3.0', 'scalar', 'gauge', 'minutes'),
+    ('ups-rfc1628', 'upsEstimatedChargeRemaining', '1.3.6.1.2.1.33.1.2.4.0', 'scalar', 'gauge', '%'),
+    ('ups-rfc1628', 'upsBatteryVoltage', '1.3.6.1.2.1.33.1.2.5.0', 'scalar', 'gauge', '0.1 V'),
+    ('ups-rfc1628', 'upsOutputPercentLoad', '1.3.6.1.2.1.33.1.4.4.1.5', 'table', 'gauge', '%')
+) AS d(group_name, name, oid, kind, data_type, units) ON d.group_name = g.name
+ON CONFLICT (group_id, oid) DO NOTHING;
+
 -- ======================================================================
 -- VERIFICATION QUERIES
 -- ======================================================================
@@ -5,4 +5,7 @@ go 1.25.4
 require (
 	github.com/gosnmp/gosnmp v1.42.1
 	github.com/lib/pq v1.10.9
+	golang.org/x/net v0.47.0
 )
+
+require golang.org/x/sys v0.38.0 // indirect
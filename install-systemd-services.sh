@@ -1,7 +1,7 @@
 #!/bin/bash
 
 # Auspex Systemd Service Installation Script
-# This script installs systemd services for poller, alerter, and API server
+# This script installs systemd services for poller, alerter, trap receiver, and API server
 
 set -e
 
@@ -96,12 +96,16 @@ fi
 
 # Build poller
 echo "  Building poller..."
-go build -o "${INSTALL_DIR}/bin/auspex-poller" "${INSTALL_DIR}/cmd/poller/main.go"
+(cd "${INSTALL_DIR}" && go build -o "${INSTALL_DIR}/bin/auspex-poller" ./cmd/poller)
 
 # Build alerter
 echo "  Building alerter..."
 go build -o "${INSTALL_DIR}/bin/auspex-alerter" "${INSTALL_DIR}/cmd/alerter/main.go"
 
+# Build trap receiver
+echo "  Building trap receiver..."
+(cd "${INSTALL_DIR}" && go build -o "${INSTALL_DIR}/bin/auspex-trapd" ./cmd/trapd)
+
 echo -e "${GREEN}  Binaries built successfully${NC}"
 
 # Step 4: Create auspex user (if doesn't exist)
@@ -136,6 +140,11 @@ EnvironmentFile=${INSTALL_DIR}/config/auspex.conf
 
 ExecStart=${INSTALL_DIR}/bin/auspex-poller
 
+# ICMP polling falls back to raw sockets when ping_group_range does not allow
+# unprivileged ICMP
+AmbientCapabilities=CAP_NET_RAW
+CapabilityBoundingSet=CAP_NET_RAW
+
 # Restart policy
 Restart=on-failure
 RestartSec=5s
@@ -197,6 +206,49 @@ EOF
 
 echo "  Created auspex-alerter.service"
 
+# Trap receiver service
+cat > /etc/systemd/system/auspex-trapd.service << EOF
+[Unit]
+Description=Auspex SNMP Trap Receiver
+Documentation=https://github.com/yourusername/auspex
+After=network.target postgresql.service
+Wants=postgresql.service
+
+[Service]
+Type=simple
+User=auspex
+Group=auspex
+WorkingDirectory=${INSTALL_DIR}
+EnvironmentFile=${INSTALL_DIR}/config/auspex.conf
+
+ExecStart=${INSTALL_DIR}/bin/auspex-trapd
+
+# UDP 162 is a privileged port
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+CapabilityBoundingSet=CAP_NET_BIND_SERVICE
+
+# Restart policy
+Restart=on-failure
+RestartSec=5s
+
+# Security hardening
+NoNewPrivileges=true
+PrivateTmp=true
+ProtectSystem=strict
+ProtectHome=true
+ReadWritePaths=${INSTALL_DIR}/logs
+
+# Logging
+StandardOutput=journal
+StandardError=journal
+SyslogIdentifier=auspex-trapd
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+echo "  Created auspex-trapd.service"
+
 # API Server service
 cat > /etc/systemd/system/auspex-api.service << EOF
 [Unit]
@@ -257,6 +309,7 @@ systemctl daemon-reload
 echo -e "${GREEN}Step 8: Enabling services...${NC}"
 systemctl enable auspex-poller.service
 systemctl enable auspex-alerter.service
+systemctl enable auspex-trapd.service
 systemctl enable auspex-api.service
 echo "  Services enabled (will start on boot)"
 
@@ -273,26 +326,30 @@ echo -e "${YELLOW}Service Management Commands:${NC}"
 echo "  Start services:"
 echo "    sudo systemctl start auspex-poller"
 echo "    sudo systemctl start auspex-alerter"
+echo "    sudo systemctl start auspex-trapd"
 echo "    sudo systemctl start auspex-api"
 echo
 echo "  Stop services:"
 echo "    sudo systemctl stop auspex-poller"
 echo "    sudo systemctl stop auspex-alerter"
+echo "    sudo systemctl stop auspex-trapd"
 echo "    sudo systemctl stop auspex-api"
 echo
 echo "  Check status:"
 echo "    sudo systemctl status auspex-poller"
 echo "    sudo systemctl status auspex-alerter"
+echo "    sudo systemctl status auspex-trapd"
 echo "    sudo systemctl status auspex-api"
 echo
 echo "  View logs:"
 echo "    sudo journalctl -u auspex-poller -f"
 echo "    sudo journalctl -u auspex-alerter -f"
+echo "    sudo journalctl -u auspex-trapd -f"
 echo "    sudo journalctl -u auspex-api -f"
 echo
 echo -e "${YELLOW}Next Steps:${NC}"
 echo "  1. Edit ${INSTALL_DIR}/config/auspex.conf"
 echo "  2. Initialize database: sudo -u postgres psql < ${INSTALL_DIR}/db-init-new.sql"
-echo "  3. Start services: sudo systemctl start auspex-{poller,alerter,api}"
+echo "  3. Start services: sudo systemctl start auspex-{poller,alerter,trapd,api}"
 echo "  4. Open http://localhost:8080 in browser"
 echo
@@ -0,0 +1,150 @@
+// Package snmpv3 maps the SNMPv3 (USM) credential columns of the targets
+// table to gosnmp's security parameters, so that the poller and trapd accept
+// the same credentials the schema stores.
+package snmpv3
+
+import (
+	"fmt"
+	"strings"
+
+	gosnmp "github.com/gosnmp/gosnmp"
+)
+
+// Credentials are the snmp_security_* columns of one target.
+type Credentials struct {
+	SecurityName   string
+	SecurityLevel  string // "" means noAuthNoPriv
+	AuthProtocol   string
+	AuthPassphrase string
+	PrivProtocol   string
+	PrivPassphrase string
+}
+
+// USM returns the message flags and User-based Security Model parameters
+// for c.
+func (c Credentials) USM() (gosnmp.SnmpV3MsgFlags, *gosnmp.UsmSecurityParameters, error) {
+	if c.SecurityName == "" {
+		return 0, nil, fmt.Errorf("snmp_security_name is required for SNMPv3")
+	}
+
+	level := c.SecurityLevel
+	if level == "" {
+		level = "noAuthNoPriv"
+	}
+
+	var flags gosnmp.SnmpV3MsgFlags
+	switch level {
+	case "noAuthNoPriv":
+		flags = gosnmp.NoAuthNoPriv
+	case "authNoPriv":
+		flags = gosnmp.AuthNoPriv
+	case "authPriv":
+		flags = gosnmp.AuthPriv
+	default:
+		return 0, nil, fmt.Errorf("unknown security level %q", c.SecurityLevel)
+	}
+
+	usm := &gosnmp.UsmSecurityParameters{
+		UserName:               c.SecurityName,
+		AuthenticationProtocol: gosnmp.NoAuth,
+		PrivacyProtocol:        gosnmp.NoPriv,
+	}
+
+	if flags&gosnmp.AuthNoPriv != 0 {
+		auth, err := ParseAuthProtocol(c.AuthProtocol)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.AuthPassphrase == "" {
+			return 0, nil, fmt.Errorf("snmp_auth_passphrase is required for %s", level)
+		}
+		usm.AuthenticationProtocol = auth
+		usm.AuthenticationPassphrase = c.AuthPassphrase
+	}
+
+	if flags == gosnmp.AuthPriv {
+		priv, err := ParsePrivProtocol(c.PrivProtocol)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.PrivPassphrase == "" {
+			return 0, nil, fmt.Errorf("snmp_priv_passphrase is required for %s", level)
+		}
+		usm.PrivacyProtocol = priv
+		usm.PrivacyPassphrase = c.PrivPassphrase
+	}
+
+	return flags, usm, nil
+}
+
+// authProtocols and privProtocols are the spellings the snmp_auth_protocol
+// and snmp_priv_protocol columns allow, in upper case.
+var authProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5":     gosnmp.MD5,
+	"SHA":     gosnmp.SHA,
+	"SHA-224": gosnmp.SHA224,
+	"SHA-256": gosnmp.SHA256,
+	"SHA-384": gosnmp.SHA384,
+	"SHA-512": gosnmp.SHA512,
+}
+
+var privProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES":      gosnmp.DES,
+	"AES-128":  gosnmp.AES,
+	"AES-192":  gosnmp.AES192,
+	"AES-256":  gosnmp.AES256,
+	"AES-192C": gosnmp.AES192C,
+	"AES-256C": gosnmp.AES256C,
+}
+
+// NormalizeAuthProtocol returns the snmp_auth_protocol spelling of s, which
+// may also be lower case or an alias such as "SHA1" or "sha256".
+func NormalizeAuthProtocol(s string) (string, error) {
+	name := strings.ToUpper(s)
+	switch name {
+	case "SHA1", "SHA-1":
+		name = "SHA"
+	case "SHA224", "SHA256", "SHA384", "SHA512":
+		name = "SHA-" + name[3:]
+	}
+	if _, ok := authProtocols[name]; !ok {
+		return "", fmt.Errorf("unknown auth protocol %q", s)
+	}
+	return name, nil
+}
+
+// NormalizePrivProtocol returns the snmp_priv_protocol spelling of s, which
+// may also be lower case or an alias such as "AES" or "aes256".
+func NormalizePrivProtocol(s string) (string, error) {
+	name := strings.ToUpper(s)
+	switch name {
+	case "AES":
+		name = "AES-128"
+	case "AES128", "AES192", "AES256", "AES192C", "AES256C":
+		name = "AES-" + name[3:]
+	}
+	if _, ok := privProtocols[name]; !ok {
+		return "", fmt.Errorf("unknown privacy protocol %q", s)
+	}
+	return name, nil
+}
+
+// ParseAuthProtocol maps an snmp_auth_protocol value to gosnmp's constant.
+func ParseAuthProtocol(s string) (gosnmp.SnmpV3AuthProtocol, error) {
+	name, err := NormalizeAuthProtocol(s)
+	if err != nil {
+		return gosnmp.NoAuth, err
+	}
+	return authProtocols[name], nil
+}
+
+// ParsePrivProtocol maps an snmp_priv_protocol value to gosnmp's constant.
+// AES-192/AES-256 use the Blumenthal key extension (RFC draft); the "C"
+// variants use the Reeder extension that Cisco devices expect.
+func ParsePrivProtocol(s string) (gosnmp.SnmpV3PrivProtocol, error) {
+	name, err := NormalizePrivProtocol(s)
+	if err != nil {
+		return gosnmp.NoPriv, err
+	}
+	return privProtocols[name], nil
+}
@@ -102,7 +102,7 @@ echo
 echo "Next steps:"
 echo "1. Review the sample data in the database"
 echo "2. Update config/auspex.conf if needed"
-echo "3. Start the poller: go run cmd/poller/main.go"
+echo "3. Start the poller: go run ./cmd/poller"
 echo "4. Start the API: node webui/server.js"
 echo "5. Open http://localhost:8080 in your browser"
 echo
@@ -46,18 +46,21 @@ echo
 echo -e "${YELLOW}Stopping services...${NC}"
 systemctl stop auspex-poller.service 2>/dev/null || echo "  auspex-poller not running"
 systemctl stop auspex-alerter.service 2>/dev/null || echo "  auspex-alerter not running"
+systemctl stop auspex-trapd.service 2>/dev/null || echo "  auspex-trapd not running"
 systemctl stop auspex-api.service 2>/dev/null || echo "  auspex-api not running"
 
 # Disable services
 echo -e "${YELLOW}Disabling services...${NC}"
 systemctl disable auspex-poller.service 2>/dev/null || true
 systemctl disable auspex-alerter.service 2>/dev/null || true
+systemctl disable auspex-trapd.service 2>/dev/null || true
 systemctl disable auspex-api.service 2>/dev/null || true
 
 # Remove service files
 echo -e "${YELLOW}Removing systemd service files...${NC}"
 rm -f /etc/systemd/system/auspex-poller.service
 rm -f /etc/systemd/system/auspex-alerter.service
+rm -f /etc/systemd/system/auspex-trapd.service
 rm -f /etc/systemd/system/auspex-api.service
 
 # Reload systemd
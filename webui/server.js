@@ -55,13 +55,16 @@ app.get("/api/targets", async (req, res) => {
 // POST /api/targets — add a target
 app.post("/api/targets", async (req, res) => {
     try {
-        const { name, host, port, community, snmp_version, enabled } = req.body;
+        const { name, host, port, community, snmp_version, enabled, check_type, check_params,
+                poll_interval_seconds } = req.body;
 
         const result = await pool.query(
-            `INSERT INTO targets (name, host, port, community, snmp_version, enabled)
-             VALUES ($1, $2, $3, $4, $5, $6)
+            `INSERT INTO targets (name, host, port, community, snmp_version, enabled, check_type, check_params,
+                                  poll_interval_seconds)
+             VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, 'snmp'), COALESCE($8::jsonb, '{}'), $9)
              RETURNING *`,
-            [name, host, port, community, snmp_version, enabled]
+            [name, host, port, community, snmp_version, enabled, check_type || null,
+             check_params ? JSON.stringify(check_params) : null, poll_interval_seconds || null]
         );
 
         res.json(result.rows[0]);
@@ -75,15 +78,21 @@ app.post("/api/targets", async (req, res) => {
 app.put("/api/targets/:id", async (req, res) => {
     try {
         const id = req.params.id;
-        const { name, host, port, community, snmp_version, enabled } = req.body;
+        const { name, host, port, community, snmp_version, enabled, check_type, check_params,
+                poll_interval_seconds } = req.body;
 
+        // poll_interval_seconds: null or 0 resets to the poller default, leaving it out keeps the current value
         const result = await pool.query(
             `UPDATE targets
              SET name=$1, host=$2, port=$3, community=$4, snmp_version=$5, enabled=$6,
+                 check_type=COALESCE($8, check_type), check_params=COALESCE($9::jsonb, check_params),
+                 poll_interval_seconds=CASE WHEN $11 THEN $10 ELSE poll_interval_seconds END,
                  updated_at=NOW()
              WHERE id=$7
              RETURNING *`,
-            [name, host, port, community, snmp_version, enabled, id]
+            [name, host, port, community, snmp_version, enabled, id, check_type || null,
+             check_params ? JSON.stringify(check_params) : null,
+             poll_interval_seconds || null, poll_interval_seconds !== undefined]
         );
 
         res.json(result.rows[0]);
@@ -195,15 +204,21 @@ app.get("/api/targets/:id/info", async (req, res) => {
 app.post("/api/targets/:id/update", async (req, res) => {
     try {
         const id = req.params.id;
-        const { name, host, port, community, snmp_version, enabled } = req.body;
+        const { name, host, port, community, snmp_version, enabled, check_type, check_params,
+                poll_interval_seconds } = req.body;
 
         const result = await pool.query(
             `UPDATE targets
              SET name=$1, host=$2, port=$3, community=$4,
-                 snmp_version=$5, enabled=$6, updated_at=NOW()
+                 snmp_version=$5, enabled=$6, check_type=COALESCE($8, check_type),
+                 check_params=COALESCE($9::jsonb, check_params),
+                 poll_interval_seconds=CASE WHEN $11 THEN $10 ELSE poll_interval_seconds END,
+                 updated_at=NOW()
              WHERE id=$7
              RETURNING *`,
-            [name, host, port, community, snmp_version, enabled, id]
+            [name, host, port, community, snmp_version, enabled, id, check_type || null,
+             check_params ? JSON.stringify(check_params) : null,
+             poll_interval_seconds || null, poll_interval_seconds !== undefined]
         );
 
         res.json(result.rows[0]);
@@ -348,14 +363,14 @@ app.get("/api/alert-rules/target/:targetId", async (req, res) => {
 // POST /api/alert-rules — create new alert rule
 app.post("/api/alert-rules", async (req, res) => {
     try {
-        const { target_id, name, rule_type, severity, enabled, channels } = req.body;
+        const { target_id, name, rule_type, severity, enabled, channels, params } = req.body;
 
         const result = await pool.query(`
-            INSERT INTO alert_rules (target_id, name, rule_type, severity, enabled, channels)
-            VALUES ($1, $2, $3, $4, $5, $6)
+            INSERT INTO alert_rules (target_id, name, rule_type, severity, enabled, channels, params)
+            VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7::jsonb, '{}'))
             RETURNING *
         `, [target_id, name, rule_type || 'status_change', severity || 'critical',
-            enabled !== false, channels || []]);
+            enabled !== false, channels || [], params ? JSON.stringify(params) : null]);
 
         res.json(result.rows[0]);
     } catch (err) {
@@ -368,14 +383,16 @@ app.post("/api/alert-rules", async (req, res) => {
 app.put("/api/alert-rules/:id", async (req, res) => {
     try {
         const id = req.params.id;
-        const { name, rule_type, severity, enabled, channels } = req.body;
+        const { name, rule_type, severity, enabled, channels, params } = req.body;
 
         const result = await pool.query(`
             UPDATE alert_rules
-            SET name=$1, rule_type=$2, severity=$3, enabled=$4, channels=$5, updated_at=NOW()
+            SET name=$1, rule_type=$2, severity=$3, enabled=$4, channels=$5,
+                params=COALESCE($7::jsonb, params), updated_at=NOW()
             WHERE id=$6
             RETURNING *
-        `, [name, rule_type, severity, enabled, channels, id]);
+        `, [name, rule_type, severity, enabled, channels, id,
+            params ? JSON.stringify(params) : null]);
 
         res.json(result.rows[0]);
     } catch (err) {